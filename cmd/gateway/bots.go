@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	raven "github.com/getsentry/raven-go"
+	"gitlab.com/Cacophony/Gateway/pkg/coordinator"
+	"go.uber.org/zap"
+)
+
+// errBotsCoordinated is returned when adding or removing bots at runtime while shard coordination is enabled,
+// as other replicas would not know about the change, the token source has to be used instead
+var errBotsCoordinated = errors.New("bots can only be changed through the token source while shard coordination is enabled")
+
+// botRegistry adds and removes bots at runtime,
+// their shards are either leased by the coordinator, or connected directly
+type botRegistry struct {
+	logger      *zap.Logger
+	sessions    *sessionManager
+	coordinator *coordinator.Coordinator
+}
+
+func newBotRegistry(
+	logger *zap.Logger,
+	sessions *sessionManager,
+	coordinatorClient *coordinator.Coordinator,
+) *botRegistry {
+	return &botRegistry{
+		logger:      logger,
+		sessions:    sessions,
+		coordinator: coordinatorClient,
+	}
+}
+
+// Register adds a bot without connecting its shards, see Start
+func (r *botRegistry) Register(botID, token string, intents discordgo.Intent, presence presence) error {
+	r.logger.Info("configured gateway intents",
+		zap.String("bot_id", botID),
+		zap.Strings("intents", intentNamesOf(intents)),
+	)
+	if unreachable := unreachableEventTypes(intents); len(unreachable) > 0 {
+		r.logger.Warn("event types will never be published, as their intents are not configured",
+			zap.String("bot_id", botID),
+			zap.Strings("event_types", unreachable),
+		)
+	}
+
+	gateway, err := r.sessions.AddBot(botID, token, intents, presence)
+	if err != nil {
+		return err
+	}
+
+	if r.coordinator != nil {
+		r.coordinator.AddBot(botID, gateway.Shards)
+	}
+
+	return nil
+}
+
+// RegisterOrRetry registers a bot like Register, if that fails it reports the bot as failed,
+// and keeps adding it with backoff in the background, unless Discord rejected its token
+func (r *botRegistry) RegisterOrRetry(botID, token string, intents discordgo.Intent, presence presence) {
+	err := r.Register(botID, token, intents, presence)
+	if err == nil {
+		return
+	}
+
+	r.sessions.SetUnavailable(botID, err)
+	go r.retry(botID, token, intents, presence, err)
+}
+
+func (r *botRegistry) retry(botID, token string, intents discordgo.Intent, presence presence, err error) {
+	for attempt := 0; ; attempt++ {
+		raven.CaptureError(err, nil)
+		if isUnauthorized(err) {
+			r.logger.Error("Discord rejected the token, giving up on bot",
+				zap.Error(err),
+				zap.String("bot_id", botID),
+			)
+			return
+		}
+
+		r.logger.Error("unable to retrieve recommended shard count, retrying",
+			zap.Error(err),
+			zap.String("bot_id", botID),
+			zap.Int("attempt", attempt),
+		)
+		time.Sleep(backoff(attempt))
+
+		// the bot might have been removed, or added by the token source, in the meantime
+		if !r.sessions.Unavailable(botID) {
+			return
+		}
+
+		err = r.Add(botID, token, intents, presence)
+		if err == nil || err == errBotAlreadyRegistered {
+			return
+		}
+		r.sessions.SetUnavailable(botID, err)
+	}
+}
+
+// isUnauthorized returns true if Discord rejected a request because of its token
+func isUnauthorized(err error) bool {
+	var restErr *discordgo.RESTError
+	return errors.As(err, &restErr) &&
+		restErr.Response != nil &&
+		restErr.Response.StatusCode == http.StatusUnauthorized
+}
+
+// Add adds a bot, and starts connecting its shards
+func (r *botRegistry) Add(botID, token string, intents discordgo.Intent, presence presence) error {
+	err := r.Register(botID, token, intents, presence)
+	if err != nil {
+		return err
+	}
+
+	// the coordinator acquires the shards of the new bot on its next heartbeat
+	if r.coordinator == nil {
+		go r.sessions.StartBot(botID)
+	}
+
+	return nil
+}
+
+// AddRuntime adds a bot which is not part of the token source, this is rejected while shard coordination is enabled
+func (r *botRegistry) AddRuntime(botID, token string, intents discordgo.Intent, presence presence) error {
+	if r.coordinator != nil {
+		return errBotsCoordinated
+	}
+
+	return r.Add(botID, token, intents, presence)
+}
+
+// RemoveRuntime removes a bot regardless of the token source, this is rejected while shard coordination is enabled
+func (r *botRegistry) RemoveRuntime(botID string) error {
+	if r.coordinator != nil {
+		return errBotsCoordinated
+	}
+
+	return r.Remove(botID)
+}
+
+// Remove disconnects all shards of a bot, and forgets about it
+func (r *botRegistry) Remove(botID string) error {
+	if r.coordinator != nil {
+		r.coordinator.RemoveBot(botID)
+	}
+
+	return r.sessions.RemoveBot(botID)
+}
+
+// tokenHandler adds and removes bots whose tokens changed in the token source,
+// with their configured intents and presence
+type tokenHandler struct {
+	bots      *botRegistry
+	intents   botIntents
+	presences botPresences
+}
+
+func (h *tokenHandler) Add(botID, token string) error {
+	return h.bots.Add(botID, token, h.intents.Get(botID), h.presences.Get(botID))
+}
+
+func (h *tokenHandler) Remove(botID string) error {
+	return h.bots.Remove(botID)
+}
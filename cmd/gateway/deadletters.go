@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"gitlab.com/Cacophony/Gateway/pkg/deadletter"
+	"gitlab.com/Cacophony/Gateway/pkg/handler"
+	"go.uber.org/zap"
+)
+
+// deadLetterRoutes lists, resubmits, and deletes dispatches which could not be converted into events
+func deadLetterRoutes(
+	logger *zap.Logger,
+	deadLetters *deadletter.Queue,
+	eventHandler *handler.EventHandler,
+) func(r chi.Router) {
+	return func(r chi.Router) {
+		// lists the newest dead letters, add ?limit=N to change the number of letters, defaults to 100
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			limit := int64(100)
+			if value := r.URL.Query().Get("limit"); value != "" {
+				var err error
+				limit, err = strconv.ParseInt(value, 10, 64)
+				if err != nil || limit < 1 {
+					http.Error(w, "invalid limit", http.StatusBadRequest)
+					return
+				}
+			}
+
+			letters, err := deadLetters.List(limit)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			writeJSON(w, logger, http.StatusOK, letters)
+		})
+
+		r.Get("/{id}", func(w http.ResponseWriter, r *http.Request) {
+			letter, err := deadLetters.Get(chi.URLParam(r, "id"))
+			if err == deadletter.ErrNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			writeJSON(w, logger, http.StatusOK, letter)
+		})
+
+		// converts a dead letter into an event again, and publishes it, the letter is removed once it has been delivered
+		r.Post("/{id}/resubmit", func(w http.ResponseWriter, r *http.Request) {
+			id := chi.URLParam(r, "id")
+
+			letter, err := deadLetters.Get(id)
+			if err == deadletter.ErrNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			err = eventHandler.Resubmit(letter)
+			if err == handler.ErrDropped {
+				// the letter is kept, the rules or routing table might be changed to publish it
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+
+			err = deadLetters.Remove(id)
+			if err != nil && err != deadletter.ErrNotFound {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			logger.Info("resubmitted dead letter",
+				zap.String("id", id),
+				zap.String("dispatch_type", letter.Type),
+				zap.String("bot_id", letter.BotID),
+			)
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		r.Delete("/{id}", func(w http.ResponseWriter, r *http.Request) {
+			id := chi.URLParam(r, "id")
+
+			err := deadLetters.Remove(id)
+			if err == deadletter.ErrNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			logger.Info("deleted dead letter", zap.String("id", id))
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"gitlab.com/Cacophony/Gateway/pkg/fakediscord"
+	"gitlab.com/Cacophony/Gateway/pkg/handler"
+	"gitlab.com/Cacophony/Gateway/pkg/handler/handlertest"
+	"gitlab.com/Cacophony/Gateway/pkg/publisher"
+	"gitlab.com/Cacophony/go-kit/discord"
+	"gitlab.com/Cacophony/go-kit/events"
+	"go.uber.org/zap"
+)
+
+const (
+	e2eToken     = "e2e-token"
+	e2eGuildID   = "180000000000000002"
+	e2eChannelID = "180000000000000003"
+	e2eUserID    = "180000000000000004"
+
+	// e2eTimeout is the time to wait for the gateway to react to something Discord did
+	e2eTimeout = 10 * time.Second
+)
+
+// e2eBots counts the bots of test runs, members are requested once per bot and process,
+// so every run uses a new bot
+var e2eBots int64
+
+// unlimitedIdentify lets shards identify right away, the fake Discord does not rate limit identifies
+type unlimitedIdentify struct{}
+
+func (unlimitedIdentify) WaitIdentify(string, int) error {
+	return nil
+}
+
+// TestGateway runs a bot against the fake Discord, with in-memory dependencies instead of Redis,
+// and follows a shard through identifying, resuming, and identifying again after its session was invalidated
+func TestGateway(t *testing.T) {
+	botID := strconv.FormatInt(180000000000000100+atomic.AddInt64(&e2eBots, 1), 10)
+
+	server, err := fakediscord.New()
+	if err != nil {
+		t.Fatalf("unable to start fake discord: %v", err)
+	}
+	defer server.Close()
+	discord.SetAPIBase(server.URL)
+
+	server.AddBot(e2eToken, &discordgo.User{ID: botID, Username: "gateway"}, 1)
+	server.AddGuild(botID, &discordgo.Guild{
+		ID:   e2eGuildID,
+		Name: "guild",
+		Channels: []*discordgo.Channel{
+			{ID: e2eChannelID, GuildID: e2eGuildID, Name: "general", Type: discordgo.ChannelTypeGuildText},
+		},
+		Members: []*discordgo.Member{
+			{GuildID: e2eGuildID, User: &discordgo.User{ID: e2eUserID, Username: "member"}},
+		},
+	})
+
+	memory := publisher.NewMemory()
+	eventHandler := handler.NewEventHandler(
+		zap.NewNop(),
+		handlertest.NewDeduplicator(),
+		memory,
+		handlertest.NewChecker(false),
+		nil,
+		handlertest.NewState(),
+		false,
+		100*time.Millisecond,
+		nil,
+		nil,
+		nil,
+	)
+	sessions := newSessionManager(zap.NewNop(), eventHandler, unlimitedIdentify{}, nil)
+
+	gateway, err := sessions.AddBot(botID, e2eToken, defaultIntents, defaultPresence)
+	if err != nil {
+		t.Fatalf("unable to add bot: %v", err)
+	}
+	if gateway.Shards != 1 {
+		t.Fatalf("expected 1 shard, got %d", gateway.Shards)
+	}
+
+	err = sessions.StartShard(botID, 0)
+	if err != nil {
+		t.Fatalf("unable to start shard: %v", err)
+	}
+	defer sessions.RemoveBot(botID) // nolint: errcheck
+
+	// the guild is sent after READY, and its members are requested once the shard is connected
+	waitForEvent(t, memory, events.GuildCreateType, nil)
+	chunk := waitForEvent(t, memory, events.GuildMembersChunkType, nil)
+	if chunk.GuildMembersChunk == nil || len(chunk.GuildMembersChunk.Members) != 1 ||
+		chunk.GuildMembersChunk.Members[0].User.ID != e2eUserID {
+		t.Errorf("expected the member of the guild in the chunk, got %+v", chunk.GuildMembersChunk)
+	}
+	expectSessions(t, server, botID, 1, 0)
+
+	dispatchMessage(t, server, botID, "600", "before disconnect")
+	waitForEvent(t, memory, events.MessageCreateType, messageContent("before disconnect"))
+
+	// Discord closing the connection with a resumable close code makes the shard resume its session
+	err = server.Disconnect(botID, 0, 4000)
+	if err != nil {
+		t.Fatalf("unable to disconnect shard: %v", err)
+	}
+	waitFor(t, "shard to resume", func() bool {
+		return server.Resumes(botID, 0) == 1
+	})
+	expectSessions(t, server, botID, 1, 1)
+
+	dispatchMessage(t, server, botID, "601", "after resume")
+	waitForEvent(t, memory, events.MessageCreateType, messageContent("after resume"))
+
+	// an invalidated session makes the shard identify again
+	err = server.InvalidateSession(botID, 0)
+	if err != nil {
+		t.Fatalf("unable to invalidate session: %v", err)
+	}
+	waitFor(t, "shard to identify again", func() bool {
+		return server.Identifies(botID, 0) == 2
+	})
+	waitFor(t, "shard to reconnect", func() bool {
+		return server.Connected(botID, 0)
+	})
+	expectSessions(t, server, botID, 2, 1)
+
+	dispatchMessage(t, server, botID, "602", "after invalid session")
+	waitForEvent(t, memory, events.MessageCreateType, messageContent("after invalid session"))
+
+	// every message is published exactly once
+	published, err := memory.Events()
+	if err != nil {
+		t.Fatalf("unable to decode published events: %v", err)
+	}
+	messages := make(map[string]int)
+	for _, event := range published {
+		if event.BotUserID != botID {
+			t.Errorf("expected bot user ID %q on %s, got %q", botID, event.Type, event.BotUserID)
+		}
+		if event.Type == events.MessageCreateType {
+			messages[event.MessageCreate.ID]++
+		}
+	}
+	for _, messageID := range []string{"600", "601", "602"} {
+		if messages[messageID] != 1 {
+			t.Errorf("expected message %s to be published once, got %d", messageID, messages[messageID])
+		}
+	}
+}
+
+// dispatchMessage sends a MESSAGE_CREATE to the shard of the guild
+func dispatchMessage(t *testing.T, server *fakediscord.Server, botID, messageID, content string) {
+	t.Helper()
+
+	err := server.DispatchGuild(botID, e2eGuildID, "MESSAGE_CREATE", &discordgo.Message{
+		ID:        messageID,
+		ChannelID: e2eChannelID,
+		GuildID:   e2eGuildID,
+		Content:   content,
+		Author:    &discordgo.User{ID: e2eUserID, Username: "member"},
+	})
+	if err != nil {
+		t.Fatalf("unable to dispatch message: %v", err)
+	}
+}
+
+func messageContent(content string) func(*events.Event) bool {
+	return func(event *events.Event) bool {
+		return event.MessageCreate != nil && event.MessageCreate.Content == content
+	}
+}
+
+// expectSessions checks how often the shard identified, and resumed its session
+func expectSessions(t *testing.T, server *fakediscord.Server, botID string, identifies, resumes int) {
+	t.Helper()
+
+	if got := server.Identifies(botID, 0); got != identifies {
+		t.Errorf("expected %d identifies, got %d", identifies, got)
+	}
+	if got := server.Resumes(botID, 0); got != resumes {
+		t.Errorf("expected %d resumes, got %d", resumes, got)
+	}
+}
+
+// waitForEvent waits until an event of the given type, which matches if set, has been published
+func waitForEvent(
+	t *testing.T,
+	memory *publisher.Memory,
+	eventType events.Type,
+	matches func(*events.Event) bool,
+) *events.Event {
+	t.Helper()
+
+	var found *events.Event
+	waitFor(t, string(eventType)+" to be published", func() bool {
+		published, err := memory.Events()
+		if err != nil {
+			t.Fatalf("unable to decode published events: %v", err)
+		}
+
+		for _, event := range published {
+			if event.Type == eventType && (matches == nil || matches(event)) {
+				found = event
+				return true
+			}
+		}
+		return false
+	})
+
+	return found
+}
+
+// waitFor polls the condition until it is true, or fails the test after e2eTimeout
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(e2eTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestGatewayUnavailableBot makes sure a bot whose token Discord rejects is reported as failed,
+// while the other bots of the process connect
+func TestGatewayUnavailableBot(t *testing.T) {
+	botID := strconv.FormatInt(180000000000000100+atomic.AddInt64(&e2eBots, 1), 10)
+	rejectedBotID := strconv.FormatInt(180000000000000100+atomic.AddInt64(&e2eBots, 1), 10)
+
+	server, err := fakediscord.New()
+	if err != nil {
+		t.Fatalf("unable to start fake discord: %v", err)
+	}
+	defer server.Close()
+	discord.SetAPIBase(server.URL)
+
+	server.AddBot(e2eToken, &discordgo.User{ID: botID, Username: "gateway"}, 1)
+
+	eventHandler := handler.NewEventHandler(
+		zap.NewNop(),
+		handlertest.NewDeduplicator(),
+		publisher.NewMemory(),
+		handlertest.NewChecker(false),
+		nil,
+		handlertest.NewState(),
+		false,
+		time.Hour,
+		nil,
+		nil,
+		nil,
+	)
+	sessions := newSessionManager(zap.NewNop(), eventHandler, unlimitedIdentify{}, nil)
+	bots := newBotRegistry(zap.NewNop(), sessions, nil)
+
+	bots.RegisterOrRetry(rejectedBotID, "rejected-token", defaultIntents, defaultPresence)
+	bots.RegisterOrRetry(botID, e2eToken, defaultIntents, defaultPresence)
+	sessions.StartAll()
+	defer sessions.Close()
+
+	waitFor(t, "shard to connect", func() bool {
+		return server.Connected(botID, 0)
+	})
+
+	statuses := sessions.Statuses()
+	if len(statuses) != 2 {
+		t.Fatalf("expected the status of 2 bots, got %d", len(statuses))
+	}
+	for _, status := range statuses {
+		switch status.BotID {
+		case botID:
+			if status.State == sessionStateFailed {
+				t.Errorf("expected bot %s not to fail, got %s", botID, status.Error)
+			}
+		case rejectedBotID:
+			if status.State != sessionStateFailed || status.Error == "" {
+				t.Errorf("expected bot %s to fail with an error, got %s", rejectedBotID, status.State)
+			}
+		default:
+			t.Errorf("unexpected bot %s", status.BotID)
+		}
+	}
+
+	err = sessions.RemoveBot(rejectedBotID)
+	if err != nil {
+		t.Fatalf("unable to remove failed bot: %v", err)
+	}
+	if _, ok := sessions.Status(rejectedBotID); ok {
+		t.Errorf("expected removed bot %s to have no status", rejectedBotID)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-redis/redis"
+	"gitlab.com/Cacophony/Gateway/pkg/handler"
+	"gitlab.com/Cacophony/Gateway/pkg/whitelist"
+	"go.uber.org/zap"
+)
+
+// healthThresholds configure when the gateway counts as unready, and when as dead
+type healthThresholds struct {
+	// UnreadyHeartbeatAge is the heartbeat ACK age of a connected shard after which the gateway is unready
+	UnreadyHeartbeatAge time.Duration
+	// DeadHeartbeatAge is the heartbeat ACK age of a connected shard after which the gateway is dead
+	DeadHeartbeatAge time.Duration
+	// DeadDisconnectedFor is the time a shard may be disconnected before the gateway is dead
+	DeadDisconnectedFor time.Duration
+	// UnreadyPublishFailures is the number of consecutive publish failures after which the gateway is unready
+	UnreadyPublishFailures int
+	// DeadPublishFailingFor is the time publishing may fail before the gateway is dead
+	DeadPublishFailingFor time.Duration
+}
+
+// healthReport is the detailed health of the gateway
+type healthReport struct {
+	Ready     bool                    `json:"ready"`
+	Alive     bool                    `json:"alive"`
+	Problems  []string                `json:"problems,omitempty"`
+	Redis     string                  `json:"redis"`
+	Publisher handler.PublisherHealth `json:"publisher"`
+	Whitelist whitelistHealth         `json:"whitelist"`
+	Bots      []BotStatus             `json:"bots"`
+}
+
+// whitelistHealth reports when the whitelist and blacklist were last retrieved successfully
+type whitelistHealth struct {
+	Enabled     bool      `json:"enabled"`
+	LastRefresh time.Time `json:"last_refresh"`
+}
+
+// healthChecker evaluates the health of all sessions, Redis, and the publisher
+type healthChecker struct {
+	sessions     *sessionManager
+	redis        *redis.Client
+	eventHandler *handler.EventHandler
+	checker      *whitelist.Checker
+	whitelisted  bool
+	thresholds   healthThresholds
+}
+
+func newHealthChecker(
+	sessions *sessionManager,
+	redisClient *redis.Client,
+	eventHandler *handler.EventHandler,
+	checker *whitelist.Checker,
+	whitelisted bool,
+	thresholds healthThresholds,
+) *healthChecker {
+	return &healthChecker{
+		sessions:     sessions,
+		redis:        redisClient,
+		eventHandler: eventHandler,
+		checker:      checker,
+		whitelisted:  whitelisted,
+		thresholds:   thresholds,
+	}
+}
+
+// Check evaluates the current health,
+// the gateway is unready while any problem is found, and dead once a problem persists past the dead thresholds
+func (h *healthChecker) Check() healthReport {
+	report := healthReport{
+		Ready:     true,
+		Alive:     true,
+		Redis:     "ok",
+		Publisher: h.eventHandler.PublisherHealth(),
+		Whitelist: whitelistHealth{
+			Enabled:     h.whitelisted,
+			LastRefresh: h.checker.LastRefresh(),
+		},
+		Bots: h.sessions.Statuses(),
+	}
+
+	unready := func(format string, args ...interface{}) {
+		report.Ready = false
+		report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+	}
+	dead := func(format string, args ...interface{}) {
+		report.Alive = false
+		unready(format, args...)
+	}
+
+	err := h.redis.Ping().Err()
+	if err != nil {
+		report.Redis = err.Error()
+		// restarting will not fix Redis, so this only affects readiness
+		unready("redis ping failed: %s", err)
+	}
+
+	if report.Publisher.ConsecutiveFailures >= h.thresholds.UnreadyPublishFailures {
+		if time.Since(report.Publisher.FailingSince) > h.thresholds.DeadPublishFailingFor {
+			dead("publishing failing since %s", report.Publisher.FailingSince)
+		} else {
+			unready("publishing failed %d times in a row", report.Publisher.ConsecutiveFailures)
+		}
+	}
+
+	for _, bot := range report.Bots {
+		// bots with a failed circuit breaker are neither fixed by waiting nor by restarting
+		if bot.State == sessionStateFailed {
+			continue
+		}
+
+		for _, shard := range bot.Shards {
+			switch shard.State {
+			case sessionStateConnected:
+				age := shard.HeartbeatAckAge()
+				if age > h.thresholds.DeadHeartbeatAge {
+					dead("bot %s shard %d heartbeat ACK is %s old", bot.BotID, shard.ShardID, age)
+				} else if age > h.thresholds.UnreadyHeartbeatAge {
+					unready("bot %s shard %d heartbeat ACK is %s old", bot.BotID, shard.ShardID, age)
+				}
+			case sessionStateConnecting, sessionStateReconnecting:
+				if time.Since(shard.Since) > h.thresholds.DeadDisconnectedFor {
+					dead("bot %s shard %d is %s since %s", bot.BotID, shard.ShardID, shard.State, shard.Since)
+				} else {
+					unready("bot %s shard %d is %s", bot.BotID, shard.ShardID, shard.State)
+				}
+			}
+		}
+	}
+
+	return report
+}
+
+// registerHealthRoutes replaces the default /status endpoint with one reflecting the health of the gateway
+func registerHealthRoutes(router chi.Router, logger *zap.Logger, health *healthChecker) {
+	// readiness
+	router.Get("/status", func(w http.ResponseWriter, _ *http.Request) {
+		report := health.Check()
+		if !report.Ready {
+			http.Error(w, "NOT READY", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte("OK")) // nolint: errcheck
+	})
+
+	// liveness
+	router.Get("/status/live", func(w http.ResponseWriter, _ *http.Request) {
+		report := health.Check()
+		if !report.Alive {
+			http.Error(w, "DEAD", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte("OK")) // nolint: errcheck
+	})
+
+	router.Get("/status/details", func(w http.ResponseWriter, _ *http.Request) {
+		report := health.Check()
+
+		status := http.StatusOK
+		if !report.Ready {
+			status = http.StatusServiceUnavailable
+		}
+
+		writeJSON(w, logger, status, report)
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// identifyInterval is the time Discord requires between identifies of the same rate limit bucket
+// https://discord.com/developers/docs/topics/gateway#sharding-max-concurrency
+const identifyInterval = 5 * time.Second
+
+// identifyLimiter blocks until the given rate limit bucket of a bot may identify
+type identifyLimiter interface {
+	WaitIdentify(botID string, bucket int) error
+}
+
+// localIdentifyLimiter limits identifies within this process
+type localIdentifyLimiter struct {
+	lock sync.Mutex
+	next map[string]time.Time
+}
+
+func newLocalIdentifyLimiter() *localIdentifyLimiter {
+	return &localIdentifyLimiter{
+		next: make(map[string]time.Time),
+	}
+}
+
+func (l *localIdentifyLimiter) WaitIdentify(botID string, bucket int) error {
+	key := botID + ":" + strconv.Itoa(bucket)
+
+	l.lock.Lock()
+	at := l.next[key]
+	if now := time.Now(); at.Before(now) {
+		at = now
+	}
+	l.next[key] = at.Add(identifyInterval)
+	l.lock.Unlock()
+
+	time.Sleep(time.Until(at))
+	return nil
+}
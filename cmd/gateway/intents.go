@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"gitlab.com/Cacophony/go-kit/events"
+)
+
+// defaultIntents are used for bots without configured intents
+const defaultIntents = discordgo.IntentsAllWithoutPrivileged | discordgo.IntentsGuildMembers
+
+// intentNames maps the names of gateway intents to their flags
+// https://discord.com/developers/docs/topics/gateway#gateway-intents
+var intentNames = map[string]discordgo.Intent{
+	"guilds":                   discordgo.IntentsGuilds,
+	"guild_members":            discordgo.IntentsGuildMembers,
+	"guild_bans":               discordgo.IntentsGuildBans,
+	"guild_emojis":             discordgo.IntentsGuildEmojis,
+	"guild_integrations":       discordgo.IntentsGuildIntegrations,
+	"guild_webhooks":           discordgo.IntentsGuildWebhooks,
+	"guild_invites":            discordgo.IntentsGuildInvites,
+	"guild_voice_states":       discordgo.IntentsGuildVoiceStates,
+	"guild_presences":          discordgo.IntentsGuildPresences,
+	"guild_messages":           discordgo.IntentsGuildMessages,
+	"guild_message_reactions":  discordgo.IntentsGuildMessageReactions,
+	"guild_message_typing":     discordgo.IntentsGuildMessageTyping,
+	"direct_messages":          discordgo.IntentsDirectMessages,
+	"direct_message_reactions": discordgo.IntentsDirectMessageReactions,
+	"direct_message_typing":    discordgo.IntentsDirectMessageTyping,
+	"message_content":          discordgo.IntentsMessageContent,
+	"guild_scheduled_events":   discordgo.IntentsGuildScheduledEvents,
+	"all_without_privileged":   discordgo.IntentsAllWithoutPrivileged,
+	"all":                      discordgo.IntentsAll,
+}
+
+// eventTypeIntents maps event types to the intents which deliver them, any one of them is sufficient,
+// event types which are not listed are delivered regardless of intents
+var eventTypeIntents = map[events.Type]discordgo.Intent{
+	events.ChannelCreateType:            discordgo.IntentsGuilds,
+	events.ChannelDeleteType:            discordgo.IntentsGuilds,
+	events.ChannelUpdateType:            discordgo.IntentsGuilds,
+	events.ChannelPinsUpdateType:        discordgo.IntentsGuilds | discordgo.IntentsDirectMessages,
+	events.GuildCreateType:              discordgo.IntentsGuilds,
+	events.GuildDeleteType:              discordgo.IntentsGuilds,
+	events.GuildUpdateType:              discordgo.IntentsGuilds,
+	events.GuildRoleCreateType:          discordgo.IntentsGuilds,
+	events.GuildRoleDeleteType:          discordgo.IntentsGuilds,
+	events.GuildRoleUpdateType:          discordgo.IntentsGuilds,
+	events.GuildMemberAddType:           discordgo.IntentsGuildMembers,
+	events.GuildMemberRemoveType:        discordgo.IntentsGuildMembers,
+	events.GuildMemberUpdateType:        discordgo.IntentsGuildMembers,
+	events.GuildMembersChunkType:        discordgo.IntentsGuildMembers,
+	events.GuildBanAddType:              discordgo.IntentsGuildBans,
+	events.GuildBanRemoveType:           discordgo.IntentsGuildBans,
+	events.GuildEmojisUpdateType:        discordgo.IntentsGuildEmojis,
+	events.GuildIntegrationsUpdateType:  discordgo.IntentsGuildIntegrations,
+	events.WebhooksUpdateType:           discordgo.IntentsGuildWebhooks,
+	events.VoiceStateUpdateType:         discordgo.IntentsGuildVoiceStates,
+	events.PresenceUpdateType:           discordgo.IntentsGuildPresences,
+	events.MessageCreateType:            discordgo.IntentsGuildMessages | discordgo.IntentsDirectMessages,
+	events.MessageUpdateType:            discordgo.IntentsGuildMessages | discordgo.IntentsDirectMessages,
+	events.MessageDeleteType:            discordgo.IntentsGuildMessages | discordgo.IntentsDirectMessages,
+	events.MessageDeleteBulkType:        discordgo.IntentsGuildMessages,
+	events.MessageReactionAddType:       discordgo.IntentsGuildMessageReactions | discordgo.IntentsDirectMessageReactions,
+	events.MessageReactionRemoveType:    discordgo.IntentsGuildMessageReactions | discordgo.IntentsDirectMessageReactions,
+	events.MessageReactionRemoveAllType: discordgo.IntentsGuildMessageReactions | discordgo.IntentsDirectMessageReactions,
+}
+
+// botIntents are the gateway intents per bot ID,
+// configured as botID=intent,intent;botID=intent, for example 123=guilds,guild_messages,message_content
+type botIntents map[string]discordgo.Intent
+
+// Decode implements envconfig.Decoder, it fails on unknown intent names
+func (b *botIntents) Decode(value string) error {
+	intents := make(botIntents)
+
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return fmt.Errorf("invalid intent configuration %q, expected botID=intent,intent", entry)
+		}
+
+		intent, err := parseIntents(parts[1])
+		if err != nil {
+			return err
+		}
+
+		intents[strings.TrimSpace(parts[0])] = intent
+	}
+
+	*b = intents
+	return nil
+}
+
+// Get returns the intents for a bot, or the default intents if none are configured
+func (b botIntents) Get(botID string) discordgo.Intent {
+	intent, ok := b[botID]
+	if !ok {
+		return defaultIntents
+	}
+
+	return intent
+}
+
+// parseIntents parses a comma separated list of intent names
+func parseIntents(value string) (discordgo.Intent, error) {
+	var intent discordgo.Intent
+
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		flag, ok := intentNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown intent %q", name)
+		}
+
+		intent |= flag
+	}
+
+	if intent == discordgo.IntentsNone {
+		return 0, fmt.Errorf("no intents in %q", value)
+	}
+
+	return intent, nil
+}
+
+// intentNamesOf returns the names of the single intents set in the given intents
+func intentNamesOf(intent discordgo.Intent) []string {
+	var names []string
+	for name, flag := range intentNames {
+		if flag&(flag-1) != 0 {
+			// skip groups of intents
+			continue
+		}
+
+		if intent&flag == flag {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// unreachableEventTypes returns the event types which will never be received with the given intents
+func unreachableEventTypes(intent discordgo.Intent) []string {
+	var types []string
+	for eventType, required := range eventTypeIntents {
+		if intent&required == 0 {
+			types = append(types, string(eventType))
+		}
+	}
+	sort.Strings(types)
+
+	return types
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,12 +13,22 @@ import (
 	"github.com/honeycombio/opentelemetry-exporter-go/honeycomb"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gitlab.com/Cacophony/Gateway/pkg/coordinator"
+	"gitlab.com/Cacophony/Gateway/pkg/deadletter"
 	"gitlab.com/Cacophony/Gateway/pkg/handler"
+	"gitlab.com/Cacophony/Gateway/pkg/metrics"
+	"gitlab.com/Cacophony/Gateway/pkg/outbox"
+	"gitlab.com/Cacophony/Gateway/pkg/publisher"
+	"gitlab.com/Cacophony/Gateway/pkg/recording"
+	"gitlab.com/Cacophony/Gateway/pkg/resume"
+	"gitlab.com/Cacophony/Gateway/pkg/routing"
+	"gitlab.com/Cacophony/Gateway/pkg/rules"
+	"gitlab.com/Cacophony/Gateway/pkg/tokens"
 	"gitlab.com/Cacophony/Gateway/pkg/whitelist"
 	"gitlab.com/Cacophony/go-kit/api"
 	"gitlab.com/Cacophony/go-kit/discord"
 	"gitlab.com/Cacophony/go-kit/errortracking"
-	"gitlab.com/Cacophony/go-kit/events"
 	"gitlab.com/Cacophony/go-kit/logging"
 	"gitlab.com/Cacophony/go-kit/state"
 	"go.opentelemetry.io/contrib/propagators/b3"
@@ -33,6 +44,15 @@ const (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		err := replay(os.Args[2:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// init config
 	var config config
 	err := envconfig.Process("", &config)
@@ -41,6 +61,12 @@ func main() {
 	}
 	config.ErrorTracking.Version = config.Hash
 	config.ErrorTracking.Environment = config.ClusterEnvironment
+	if config.ReplicaID == "" {
+		config.ReplicaID, err = os.Hostname()
+		if err != nil {
+			panic(errors.Wrap(err, "unable to determine replica ID"))
+		}
+	}
 
 	discord.SetAPIBase(config.DiscordAPIBase)
 
@@ -98,6 +124,12 @@ func main() {
 		))
 	}
 
+	// resuming sessions depends on unexported fields of discordgo sessions
+	err = checkSessionFields()
+	if err != nil {
+		logger.Fatal("unable to resume discord sessions with this discordgo version", zap.Error(err))
+	}
+
 	// init raven
 	err = errortracking.Init(&config.ErrorTracking)
 	if err != nil {
@@ -119,6 +151,53 @@ func main() {
 		)
 	}
 
+	// init token source
+	var tokenWatcher *tokens.Watcher
+	switch {
+	case config.TokensFile != "":
+		tokenWatcher = tokens.NewWatcher(
+			tokens.NewFileSource(config.TokensFile),
+			logger.With(zap.String("feature", "Tokens")),
+			config.TokensReloadInterval,
+		)
+	case config.TokensRedisKey != "":
+		tokenWatcher = tokens.NewWatcher(
+			tokens.NewRedisSource(redisClient, config.TokensRedisKey),
+			logger.With(zap.String("feature", "Tokens")),
+			config.TokensReloadInterval,
+		)
+	}
+	if config.DiscordTokens == nil {
+		config.DiscordTokens = make(map[string]string)
+	}
+	if tokenWatcher != nil {
+		watchedTokens, err := tokenWatcher.Load()
+		if err != nil {
+			logger.Fatal("unable to load tokens", zap.Error(err))
+		}
+
+		for botID, token := range watchedTokens {
+			if _, ok := config.DiscordTokens[botID]; ok {
+				logger.Fatal("bot is configured in DISCORD_TOKENS and in the token source",
+					zap.String("bot_id", botID),
+				)
+			}
+			config.DiscordTokens[botID] = token
+		}
+	} else {
+		// with a token source, bots might be added later on
+		for botID := range config.DiscordIntents {
+			if _, ok := config.DiscordTokens[botID]; !ok {
+				logger.Fatal("intents configured for unknown bot", zap.String("bot_id", botID))
+			}
+		}
+		for botID := range config.DiscordPresences {
+			if _, ok := config.DiscordTokens[botID]; !ok {
+				logger.Fatal("presence configured for unknown bot", zap.String("bot_id", botID))
+			}
+		}
+	}
+
 	// init whitelist checker
 	checker := whitelist.NewChecker(
 		redisClient,
@@ -133,32 +212,162 @@ func main() {
 		)
 	}
 
+	// init rules
+	var filter handler.Filter
+	if config.EnableRules {
+		ruleEngine := rules.NewEngine(
+			redisClient,
+			logger,
+			config.RulesInterval,
+		)
+		err = ruleEngine.Start()
+		if err != nil {
+			logger.Fatal("unable to initialise rules",
+				zap.Error(err),
+			)
+		}
+		filter = ruleEngine
+	}
+
 	// init state
 	stateClient := state.NewState(redisClient, nil)
 
 	// init publisher
-	publisher, err := events.NewPublisher(
-		config.AMQPDSN, nil,
-	)
+	// PUBLISHER_DSN selects the transport, AMQP_DSN is kept for existing deployments
+	publisherDSN := config.PublisherDSN
+	if publisherDSN == "" {
+		publisherDSN = config.AMQPDSN
+	}
+	eventPublisher, err := publisher.New(publisherDSN)
 	if err != nil {
 		logger.Fatal("unable to initialise Publisher",
 			zap.Error(err),
 		)
 	}
 
+	// init outbox
+	var eventOutbox *outbox.Outbox
+	if config.OutboxDir != "" {
+		eventOutbox, err = outbox.Open(config.OutboxDir, config.OutboxMaxBytes)
+		if err != nil {
+			logger.Fatal("unable to open outbox",
+				zap.Error(err),
+			)
+		}
+		defer eventOutbox.Close() // nolint: errcheck
+	}
+
+	// init routing table
+	var routes *routing.Table
+	if config.RoutesFile != "" {
+		routes, err = routing.Load(config.RoutesFile)
+		if err != nil {
+			logger.Fatal("unable to load routing table",
+				zap.Error(err),
+			)
+		}
+	}
+
+	// init recording
+	var recorder *recording.Recorder
+	if config.RecordFile != "" {
+		recorder, err = recording.Create(config.RecordFile)
+		if err != nil {
+			logger.Fatal("unable to create recording",
+				zap.Error(err),
+			)
+		}
+		defer recorder.Close() // nolint: errcheck
+	}
+
+	// init dead letters
+	var deadLetters *deadletter.Queue
+	if config.DeadLetters && config.DeadLetterMax > 0 {
+		deadLetters = deadletter.NewQueue(redisClient, config.DeadLetterMax)
+	}
+
 	// init event handler
 	eventHandler := handler.NewEventHandler(
 		logger.With(zap.String("feature", "EventHandler")),
-		redisClient,
-		publisher,
+		handler.NewRedisDeduplicator(redisClient),
+		eventPublisher,
 		checker,
+		filter,
 		stateClient,
 		config.Deduplicate,
 		config.RequestMembersDelay,
+		eventOutbox,
+		routes,
+		deadLetters,
+	)
+	go eventHandler.RedeliverOutbox(config.OutboxRetryInterval)
+	if config.PublishAsync {
+		eventHandler.StartPipeline(
+			config.PublishLanes,
+			config.PublishBuffer,
+			config.PublishBatchSize,
+			config.PublishBatchTimeout,
+		)
+	}
+	eventHandler.StartWorkers(config.HandlerWorkers, config.HandlerBuffer)
+	if config.RawPassthrough {
+		eventHandler.EnableRawPassthrough()
+	}
+	if recorder != nil {
+		eventHandler.Record(recorder)
+	}
+
+	// launch all sessions:
+	var coordinatorClient *coordinator.Coordinator
+	var identify identifyLimiter = newLocalIdentifyLimiter()
+	if config.ShardCoordination {
+		coordinatorClient = coordinator.NewCoordinator(
+			redisClient,
+			logger.With(zap.String("feature", "Coordinator")),
+			config.ReplicaID,
+			config.ShardLeaseTTL,
+			config.HandoverTimeout,
+		)
+		identify = coordinatorClient
+	}
+
+	var resumeStore *resume.Store
+	if config.ResumeState {
+		resumeStore = resume.NewStore(redisClient, config.ResumeStateTTL)
+	}
+
+	sessions := newSessionManager(
+		logger,
+		eventHandler,
+		identify,
+		resumeStore,
 	)
+	bots := newBotRegistry(logger, sessions, coordinatorClient)
 
 	// init http server
 	httpRouter := api.NewRouter()
+	httpRouter.Handle("/metrics", promhttp.Handler())
+	metrics.RegisterShards(sessions.Heartbeats)
+	registerHealthRoutes(
+		httpRouter,
+		logger.With(zap.String("feature", "http-server")),
+		newHealthChecker(sessions, redisClient, eventHandler, checker, config.EnableWhitelist, healthThresholds{
+			UnreadyHeartbeatAge:    config.UnreadyHeartbeatAge,
+			DeadHeartbeatAge:       config.DeadHeartbeatAge,
+			DeadDisconnectedFor:    config.DeadDisconnectedFor,
+			UnreadyPublishFailures: config.UnreadyPublishFailures,
+			DeadPublishFailingFor:  config.DeadPublishFailingFor,
+		}),
+	)
+	registerRoutes(
+		httpRouter,
+		logger.With(zap.String("feature", "http-server")),
+		config.AdminToken,
+		sessions,
+		bots,
+		eventHandler,
+		deadLetters,
+	)
 	httpServer := api.NewHTTPServer(config.Port, httpRouter)
 
 	go func() {
@@ -171,22 +380,46 @@ func main() {
 		}
 	}()
 
-	// launch all sessions:
-	discordCloseChannel := make(chan interface{}, len(config.DiscordTokens))
+	// bots which can not be registered are reported as failed, and do not keep the other bots from starting
 	for botID, token := range config.DiscordTokens {
-		NewSession(
-			logger.With(zap.String("bot_id", botID)),
+		bots.RegisterOrRetry(
+			botID,
 			token,
-			eventHandler,
-			discordCloseChannel,
+			config.DiscordIntents.Get(botID),
+			config.DiscordPresences.Get(botID),
 		)
 	}
 
+	if coordinatorClient != nil {
+		coordinatorClient.Start(sessions)
+	} else {
+		sessions.StartAll()
+	}
+	go sessions.PersistResumeStates(config.ResumeStateInterval)
+	go sessions.RotatePresences()
+	if tokenWatcher != nil {
+		go tokenWatcher.Watch(&tokenHandler{
+			bots:      bots,
+			intents:   config.DiscordIntents,
+			presences: config.DiscordPresences,
+		})
+	}
+
 	logger.Info("service is running",
 		zap.Int("port", config.Port),
 		zap.Bool("whitelist_enabled", config.EnableWhitelist),
+		zap.Bool("rules_enabled", config.EnableRules),
 		zap.Bool("deduplicate", config.Deduplicate),
 		zap.Duration("request_members_delay", config.RequestMembersDelay),
+		zap.Bool("shard_coordination", config.ShardCoordination),
+		zap.String("replica_id", config.ReplicaID),
+		zap.Bool("resume_state", config.ResumeState),
+		zap.Bool("token_source", tokenWatcher != nil),
+		zap.Bool("outbox", eventOutbox != nil),
+		zap.Bool("publish_async", config.PublishAsync),
+		zap.Bool("raw_passthrough", config.RawPassthrough),
+		zap.Bool("dead_letters", deadLetters != nil),
+		zap.Bool("recording", recorder != nil),
 	)
 
 	// wait for CTRL+C to stop the service
@@ -196,17 +429,21 @@ func main() {
 
 	// shutdown features
 
+	// close all sessions, and wait for them to be closed
+	if coordinatorClient != nil {
+		coordinatorClient.Stop()
+	}
+	sessions.Close()
+
+	// handle and publish the events still buffered
+	eventHandler.Close()
+
+	// the handover might take longer than the shutdown timeout, so it starts afterwards
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
 	defer cancel()
 
-	// tell all sessions to close
-	for i := 0; i < cap(discordCloseChannel); i++ {
-		discordCloseChannel <- nil
-	}
-	// wait for all discord channels to close
-	for i := 0; i < cap(discordCloseChannel); i++ {
-		<-discordCloseChannel
-	}
+	// try once more to publish the events which failed before, including the ones buffered until now
+	eventHandler.DrainOutbox(ctx, time.Second)
 
 	err = httpServer.Shutdown(ctx)
 	if err != nil {
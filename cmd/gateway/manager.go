@@ -0,0 +1,702 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	raven "github.com/getsentry/raven-go"
+	"github.com/gorilla/websocket"
+	"gitlab.com/Cacophony/Gateway/pkg/handler"
+	"gitlab.com/Cacophony/Gateway/pkg/metrics"
+	"gitlab.com/Cacophony/Gateway/pkg/resume"
+	"gitlab.com/Cacophony/go-kit/logging"
+	"go.uber.org/zap"
+)
+
+var (
+	errBotNotRegistered     = errors.New("bot is not registered")
+	errBotAlreadyRegistered = errors.New("bot is already registered")
+	errShardNotRunning      = errors.New("shard is not running")
+)
+
+// sessionManager keeps track of the shard sessions of all bots run by this process
+type sessionManager struct {
+	logger       *zap.Logger
+	eventHandler *handler.EventHandler
+	identify     identifyLimiter
+	resumeStore  *resume.Store
+
+	botsLock sync.RWMutex
+	bots     map[string]*bot
+	// unavailable are bots which could not be registered, with the reason, see SetUnavailable
+	unavailable map[string]error
+}
+
+type bot struct {
+	id      string
+	token   string
+	intents discordgo.Intent
+	logger  *zap.Logger
+	gateway *discordgo.GatewayBotResponse
+
+	shardsLock sync.Mutex
+	shards     map[int]*supervisor
+
+	presenceLock    sync.Mutex
+	presence        presence
+	presenceIndex   int
+	presenceRotated time.Time
+
+	// failure opens the circuit breaker of the bot, once Discord rejected its token or intents
+	failureLock sync.RWMutex
+	failure     error
+}
+
+// trip opens the circuit breaker of the bot, so no shard of it will try to connect again
+func (b *bot) trip(err error) {
+	b.failureLock.Lock()
+	defer b.failureLock.Unlock()
+
+	if b.failure == nil {
+		b.failure = err
+	}
+}
+
+// tripped returns the error which opened the circuit breaker of the bot, if it is open
+func (b *bot) tripped() error {
+	b.failureLock.RLock()
+	defer b.failureLock.RUnlock()
+
+	return b.failure
+}
+
+// statusData returns the current presence update of the bot
+func (b *bot) statusData() discordgo.UpdateStatusData {
+	b.presenceLock.Lock()
+	defer b.presenceLock.Unlock()
+
+	return b.presence.statusData(b.presenceIndex)
+}
+
+// BotStatus is the connection status of a bot and all its shards run by this process
+type BotStatus struct {
+	BotID      string        `json:"bot_id"`
+	State      sessionState  `json:"state"`
+	Error      string        `json:"error,omitempty"`
+	ShardCount int           `json:"shard_count"`
+	Shards     []ShardStatus `json:"shards"`
+}
+
+func newSessionManager(
+	logger *zap.Logger,
+	eventHandler *handler.EventHandler,
+	identify identifyLimiter,
+	resumeStore *resume.Store,
+) *sessionManager {
+	discordgo.Logger = logging.DiscordgoLogger(
+		logger.With(zap.String("feature", "discordgo")),
+	)
+
+	return &sessionManager{
+		logger:       logger,
+		eventHandler: eventHandler,
+		identify:     identify,
+		resumeStore:  resumeStore,
+		bots:         make(map[string]*bot),
+		unavailable:  make(map[string]error),
+	}
+}
+
+// AddBot registers a bot, and retrieves its recommended shard count, it does not connect any shards
+func (m *sessionManager) AddBot(
+	botID, token string,
+	intents discordgo.Intent,
+	presence presence,
+) (*discordgo.GatewayBotResponse, error) {
+	logger := m.logger.With(zap.String("bot_id", botID))
+
+	m.botsLock.RLock()
+	_, exists := m.bots[botID]
+	m.botsLock.RUnlock()
+	if exists {
+		return nil, errBotAlreadyRegistered
+	}
+
+	gateway, err := gatewayBot(token)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("retrieved recommended shard count",
+		zap.Int("shard_count", gateway.Shards),
+		zap.Int("max_concurrency", gateway.SessionStartLimit.MaxConcurrency),
+	)
+
+	m.botsLock.Lock()
+	defer m.botsLock.Unlock()
+	if _, exists := m.bots[botID]; exists {
+		return nil, errBotAlreadyRegistered
+	}
+	delete(m.unavailable, botID)
+	m.bots[botID] = &bot{
+		id:              botID,
+		token:           token,
+		intents:         intents,
+		logger:          logger,
+		gateway:         gateway,
+		shards:          make(map[int]*supervisor),
+		presence:        presence,
+		presenceRotated: time.Now(),
+	}
+
+	return gateway, nil
+}
+
+// SetUnavailable reports a bot which could not be registered as failed, until it is added or removed
+func (m *sessionManager) SetUnavailable(botID string, err error) {
+	m.botsLock.Lock()
+	defer m.botsLock.Unlock()
+
+	if _, exists := m.bots[botID]; exists {
+		return
+	}
+	m.unavailable[botID] = err
+}
+
+// Unavailable returns true if the bot could not be registered, and has neither been added nor removed since
+func (m *sessionManager) Unavailable(botID string) bool {
+	m.botsLock.RLock()
+	defer m.botsLock.RUnlock()
+
+	_, unavailable := m.unavailable[botID]
+	return unavailable
+}
+
+// RemoveBot closes all running shards of a bot, and forgets about it
+func (m *sessionManager) RemoveBot(botID string) error {
+	m.botsLock.Lock()
+	b := m.bots[botID]
+	delete(m.bots, botID)
+	_, unavailable := m.unavailable[botID]
+	delete(m.unavailable, botID)
+	m.botsLock.Unlock()
+	if b == nil {
+		if unavailable {
+			return nil
+		}
+		return errBotNotRegistered
+	}
+
+	m.closeShards(b)
+
+	b.logger.Info("removed bot")
+	return nil
+}
+
+// StartShard connects the given shard of a bot, resuming its previous session if possible
+func (m *sessionManager) StartShard(botID string, shardID int) error {
+	return m.startShard(botID, shardID, true)
+}
+
+// TakeOverShard connects the given shard of a bot while it is still connected elsewhere,
+// it always identifies, as resuming would disconnect the other session
+func (m *sessionManager) TakeOverShard(botID string, shardID int) error {
+	return m.startShard(botID, shardID, false)
+}
+
+// SetOverlap forces deduplication of the events of a shard while it is connected elsewhere too
+func (m *sessionManager) SetOverlap(botID string, shardID int, overlap bool) {
+	m.eventHandler.SetOverlap(botID, shardID, overlap)
+}
+
+func (m *sessionManager) startShard(botID string, shardID int, resumeSession bool) error {
+	m.botsLock.RLock()
+	b := m.bots[botID]
+	m.botsLock.RUnlock()
+	if b == nil {
+		return errBotNotRegistered
+	}
+	if shardID < 0 || shardID >= b.gateway.Shards {
+		return errors.New("shard ID is out of bounds")
+	}
+
+	if err := b.tripped(); err != nil {
+		return err
+	}
+
+	b.shardsLock.Lock()
+	_, running := b.shards[shardID]
+	b.shardsLock.Unlock()
+	if running {
+		return nil
+	}
+
+	logger := b.logger.With(zap.Int("shard_id", shardID), zap.Int("shard_count", b.gateway.Shards))
+
+	var resumeState *resume.State
+	if m.resumeStore != nil && resumeSession {
+		var err error
+		resumeState, err = m.resumeStore.Get(botID, shardID)
+		if err != nil {
+			logger.Error("unable to retrieve resume state", zap.Error(err))
+		}
+	}
+
+	tracker := newResumeTracker(resumeState)
+	discordSession, err := NewSession(
+		b.id,
+		b.token,
+		shardID,
+		b.gateway.Shards,
+		b.intents,
+		m.eventHandler,
+		tracker,
+	)
+	if err != nil {
+		return err
+	}
+
+	// closing with a normal closure would invalidate the session, so we close as if restarting if we can resume later
+	closeCode := websocket.CloseNormalClosure
+	if m.resumeStore != nil {
+		closeCode = websocket.CloseServiceRestart
+	}
+
+	s := newSupervisor(
+		logger,
+		b,
+		shardID,
+		discordSession,
+		tracker,
+		resumeState,
+		func() error {
+			// shards with the same shard_id % max_concurrency share a rate limit bucket
+			return m.identify.WaitIdentify(botID, shardID%b.gateway.SessionStartLimit.MaxConcurrency)
+		},
+		closeCode,
+	)
+
+	// another call might have started the shard while the session was created
+	b.shardsLock.Lock()
+	if _, running := b.shards[shardID]; running {
+		b.shardsLock.Unlock()
+		return nil
+	}
+	b.shards[shardID] = s
+	b.shardsLock.Unlock()
+
+	err = s.Start()
+	if err != nil {
+		b.shardsLock.Lock()
+		if b.shards[shardID] == s {
+			delete(b.shards, shardID)
+		}
+		b.shardsLock.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+// StopShard closes the given shard of a bot, if it is running, and stores its session for resuming
+func (m *sessionManager) StopShard(botID string, shardID int) error {
+	m.botsLock.RLock()
+	b := m.bots[botID]
+	m.botsLock.RUnlock()
+	if b == nil {
+		return nil
+	}
+
+	return m.stopShard(b, shardID, false)
+}
+
+// DropShard closes the given shard of a bot, if it is running, without touching its stored resume state,
+// as that belongs to the session of another replica
+func (m *sessionManager) DropShard(botID string, shardID int) error {
+	m.botsLock.RLock()
+	b := m.bots[botID]
+	m.botsLock.RUnlock()
+	if b == nil {
+		return nil
+	}
+
+	return m.stopShard(b, shardID, true)
+}
+
+func (m *sessionManager) stopShard(b *bot, shardID int, dropped bool) error {
+	b.shardsLock.Lock()
+	s := b.shards[shardID]
+	delete(b.shards, shardID)
+	b.shardsLock.Unlock()
+	if s == nil {
+		return nil
+	}
+
+	b.logger.Info("closing shard", zap.Int("shard_id", shardID), zap.Bool("dropped", dropped))
+
+	err := s.Stop()
+	if err != nil {
+		return err
+	}
+
+	if m.resumeStore == nil || dropped {
+		return nil
+	}
+
+	state := s.tracker.State()
+	if !state.Resumable() {
+		return m.resumeStore.Delete(b.id, shardID)
+	}
+
+	return m.resumeStore.Set(b.id, shardID, state)
+}
+
+// ReconnectShard forces a new connection of the given shard of a bot, resuming its session if resumeSession is set
+func (m *sessionManager) ReconnectShard(botID string, shardID int, resumeSession bool) error {
+	m.botsLock.RLock()
+	b := m.bots[botID]
+	m.botsLock.RUnlock()
+	if b == nil {
+		return errBotNotRegistered
+	}
+
+	b.shardsLock.Lock()
+	s := b.shards[shardID]
+	b.shardsLock.Unlock()
+	if s == nil {
+		return errShardNotRunning
+	}
+
+	s.Reconnect(resumeSession)
+	return nil
+}
+
+// Status returns the connection status of a bot, and false if the bot is not registered
+func (m *sessionManager) Status(botID string) (BotStatus, bool) {
+	m.botsLock.RLock()
+	b := m.bots[botID]
+	unavailableErr, unavailable := m.unavailable[botID]
+	m.botsLock.RUnlock()
+	if b == nil {
+		if unavailable {
+			return BotStatus{
+				BotID: botID,
+				State: sessionStateFailed,
+				Error: unavailableErr.Error(),
+			}, true
+		}
+		return BotStatus{}, false
+	}
+
+	status := BotStatus{
+		BotID:      b.id,
+		State:      sessionStateStopped,
+		ShardCount: b.gateway.Shards,
+	}
+
+	b.shardsLock.Lock()
+	for _, s := range b.shards {
+		status.Shards = append(status.Shards, s.Status())
+	}
+	b.shardsLock.Unlock()
+	sort.Slice(status.Shards, func(i, j int) bool {
+		return status.Shards[i].ShardID < status.Shards[j].ShardID
+	})
+
+	// the bot is in the worst state of any of its shards
+	for _, shard := range status.Shards {
+		if sessionStateSeverity[shard.State] > sessionStateSeverity[status.State] || status.State == sessionStateStopped {
+			status.State = shard.State
+		}
+	}
+
+	if err := b.tripped(); err != nil {
+		status.State = sessionStateFailed
+		status.Error = err.Error()
+	}
+
+	return status, true
+}
+
+// Statuses returns the connection status of all registered bots, and of the bots which could not be registered
+func (m *sessionManager) Statuses() []BotStatus {
+	m.botsLock.RLock()
+	botIDs := make([]string, 0, len(m.bots)+len(m.unavailable))
+	for botID := range m.bots {
+		botIDs = append(botIDs, botID)
+	}
+	for botID := range m.unavailable {
+		botIDs = append(botIDs, botID)
+	}
+	m.botsLock.RUnlock()
+	sort.Strings(botIDs)
+
+	statuses := make([]BotStatus, 0, len(botIDs))
+	for _, botID := range botIDs {
+		status, ok := m.Status(botID)
+		if ok {
+			statuses = append(statuses, status)
+		}
+	}
+
+	return statuses
+}
+
+// Heartbeats returns the latest heartbeat measurements of all running shards
+func (m *sessionManager) Heartbeats() []metrics.ShardHeartbeat {
+	var heartbeats []metrics.ShardHeartbeat
+	for _, bot := range m.Statuses() {
+		for _, shard := range bot.Shards {
+			heartbeats = append(heartbeats, metrics.ShardHeartbeat{
+				BotID:          bot.BotID,
+				ShardID:        shard.ShardID,
+				Connected:      shard.State == sessionStateConnected,
+				LatencySeconds: float64(shard.LatencyMS) / 1000,
+				AckAgeSeconds:  shard.HeartbeatAckAge().Seconds(),
+			})
+		}
+	}
+
+	return heartbeats
+}
+
+// Presence returns the presence of a bot, and false if the bot is not registered
+func (m *sessionManager) Presence(botID string) (presence, bool) {
+	m.botsLock.RLock()
+	b := m.bots[botID]
+	m.botsLock.RUnlock()
+	if b == nil {
+		return presence{}, false
+	}
+
+	b.presenceLock.Lock()
+	defer b.presenceLock.Unlock()
+
+	return b.presence, true
+}
+
+// SetPresence replaces the presence of a bot, and updates it on all connected shards
+func (m *sessionManager) SetPresence(botID string, p presence) error {
+	err := p.validate()
+	if err != nil {
+		return err
+	}
+
+	m.botsLock.RLock()
+	b := m.bots[botID]
+	m.botsLock.RUnlock()
+	if b == nil {
+		return errBotNotRegistered
+	}
+
+	b.presenceLock.Lock()
+	b.presence = p
+	b.presenceIndex = 0
+	b.presenceRotated = time.Now()
+	b.presenceLock.Unlock()
+
+	m.updatePresences(b)
+
+	return nil
+}
+
+// RotatePresences moves on to the next activity of bots whose presence rotates
+func (m *sessionManager) RotatePresences() {
+	for {
+		time.Sleep(time.Second)
+
+		m.botsLock.RLock()
+		bots := make([]*bot, 0, len(m.bots))
+		for _, b := range m.bots {
+			bots = append(bots, b)
+		}
+		m.botsLock.RUnlock()
+
+		for _, b := range bots {
+			b.presenceLock.Lock()
+			rotate := len(b.presence.Activities) > 1 &&
+				b.presence.interval > 0 &&
+				time.Since(b.presenceRotated) >= b.presence.interval
+			if rotate {
+				b.presenceIndex = (b.presenceIndex + 1) % len(b.presence.Activities)
+				b.presenceRotated = time.Now()
+			}
+			b.presenceLock.Unlock()
+
+			if rotate {
+				m.updatePresences(b)
+			}
+		}
+	}
+}
+
+// updatePresences sends the current presence of a bot to all its connected shards
+func (m *sessionManager) updatePresences(b *bot) {
+	data := b.statusData()
+
+	b.shardsLock.Lock()
+	supervisors := make([]*supervisor, 0, len(b.shards))
+	for _, s := range b.shards {
+		supervisors = append(supervisors, s)
+	}
+	b.shardsLock.Unlock()
+
+	for _, s := range supervisors {
+		if s.Status().State != sessionStateConnected {
+			continue
+		}
+
+		updatePresence(s.logger, s.session, data)
+	}
+}
+
+// PersistResumeStates periodically stores the resume states of all running shards
+func (m *sessionManager) PersistResumeStates(interval time.Duration) {
+	if m.resumeStore == nil {
+		return
+	}
+
+	type shardState struct {
+		bot        *bot
+		shardID    int
+		supervisor *supervisor
+		state      *resume.State
+	}
+
+	for {
+		time.Sleep(interval)
+
+		// the states are copied first, so a slow Redis does not hold up starting and stopping shards
+		var states []shardState
+		m.botsLock.RLock()
+		for _, b := range m.bots {
+			b.shardsLock.Lock()
+			for shardID, s := range b.shards {
+				state := s.tracker.State()
+				if !state.Resumable() {
+					continue
+				}
+
+				states = append(states, shardState{bot: b, shardID: shardID, supervisor: s, state: state})
+			}
+			b.shardsLock.Unlock()
+		}
+		m.botsLock.RUnlock()
+
+		for _, shard := range states {
+			// shards stopped in the meantime have stored their final state, or left it to another replica
+			shard.bot.shardsLock.Lock()
+			running := shard.bot.shards[shard.shardID] == shard.supervisor
+			shard.bot.shardsLock.Unlock()
+			if !running {
+				continue
+			}
+
+			err := m.resumeStore.Set(shard.bot.id, shard.shardID, shard.state)
+			if err != nil {
+				raven.CaptureError(err, nil)
+				shard.bot.logger.Error("unable to store resume state",
+					zap.Error(err),
+					zap.Int("shard_id", shard.shardID),
+				)
+			}
+		}
+	}
+}
+
+// StartAll connects all shards of all bots, and waits for them to be connected
+func (m *sessionManager) StartAll() {
+	var wg sync.WaitGroup
+
+	m.botsLock.RLock()
+	for botID := range m.bots {
+		wg.Add(1)
+		go func(botID string) {
+			defer wg.Done()
+
+			m.StartBot(botID)
+		}(botID)
+	}
+	m.botsLock.RUnlock()
+
+	wg.Wait()
+}
+
+// StartBot connects all shards of a bot, and waits for them to be connected
+func (m *sessionManager) StartBot(botID string) {
+	m.botsLock.RLock()
+	b := m.bots[botID]
+	m.botsLock.RUnlock()
+	if b == nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for shardID := 0; shardID < b.gateway.Shards; shardID++ {
+		wg.Add(1)
+		go func(shardID int) {
+			defer wg.Done()
+
+			err := m.StartShard(b.id, shardID)
+			if err != nil {
+				raven.CaptureError(err, nil)
+				b.logger.Error("unable to start shard",
+					zap.Error(err),
+					zap.Int("shard_id", shardID),
+				)
+			}
+		}(shardID)
+	}
+
+	wg.Wait()
+}
+
+// Close closes all running shards of all bots, and waits for them to be closed
+func (m *sessionManager) Close() {
+	var wg sync.WaitGroup
+
+	m.botsLock.RLock()
+	for _, b := range m.bots {
+		wg.Add(1)
+		go func(b *bot) {
+			defer wg.Done()
+
+			m.closeShards(b)
+		}(b)
+	}
+	m.botsLock.RUnlock()
+
+	wg.Wait()
+}
+
+// closeShards closes all running shards of a bot, and waits for them to be closed
+func (m *sessionManager) closeShards(b *bot) {
+	b.shardsLock.Lock()
+	shardIDs := make([]int, 0, len(b.shards))
+	for shardID := range b.shards {
+		shardIDs = append(shardIDs, shardID)
+	}
+	b.shardsLock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, shardID := range shardIDs {
+		wg.Add(1)
+		go func(shardID int) {
+			defer wg.Done()
+
+			err := m.stopShard(b, shardID, false)
+			if err != nil {
+				b.logger.Error("unable to close discord session",
+					zap.Error(err),
+					zap.Int("shard_id", shardID),
+				)
+			}
+		}(shardID)
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// presenceActivityTypes maps the names of activity types to their discordgo values
+var presenceActivityTypes = map[string]discordgo.ActivityType{
+	"game":      discordgo.ActivityTypeGame,
+	"streaming": discordgo.ActivityTypeStreaming,
+	"listening": discordgo.ActivityTypeListening,
+	"watching":  discordgo.ActivityTypeWatching,
+	"competing": discordgo.ActivityTypeCompeting,
+}
+
+// presenceStatuses are the statuses a bot can set
+var presenceStatuses = map[string]bool{
+	string(discordgo.StatusOnline):       true,
+	string(discordgo.StatusIdle):         true,
+	string(discordgo.StatusDoNotDisturb): true,
+	string(discordgo.StatusInvisible):    true,
+}
+
+// presenceActivity is a single activity shown in the presence of a bot
+type presenceActivity struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+	// URL is required for, and only shown for streaming activities
+	URL string `json:"url,omitempty"`
+}
+
+// presence is the presence of a bot, if multiple activities are configured, they are rotated on every interval
+type presence struct {
+	Status     string             `json:"status"`
+	Activities []presenceActivity `json:"activities"`
+	Interval   string             `json:"interval,omitempty"`
+
+	interval time.Duration
+}
+
+// defaultPresence is used for bots without a configured presence
+var defaultPresence = presence{
+	Status: string(discordgo.StatusOnline),
+	Activities: []presenceActivity{
+		{Type: "game", Name: ".help"},
+	},
+}
+
+// validate checks the presence, and parses its interval
+func (p *presence) validate() error {
+	if p.Status == "" {
+		p.Status = string(discordgo.StatusOnline)
+	}
+	if !presenceStatuses[p.Status] {
+		return fmt.Errorf("unknown status %q", p.Status)
+	}
+
+	for _, activity := range p.Activities {
+		if _, ok := presenceActivityTypes[activity.Type]; !ok {
+			return fmt.Errorf("unknown activity type %q", activity.Type)
+		}
+		if activity.Name == "" {
+			return errors.New("activity name is required")
+		}
+		if activity.Type == "streaming" {
+			// Discord shows streaming activities without a valid URL as playing
+			streamURL, err := url.Parse(activity.URL)
+			if activity.URL == "" || err != nil || (streamURL.Scheme != "http" && streamURL.Scheme != "https") {
+				return fmt.Errorf("streaming activity %q requires an http or https URL", activity.Name)
+			}
+		}
+	}
+
+	p.interval = 0
+	if p.Interval != "" {
+		interval, err := time.ParseDuration(p.Interval)
+		if err != nil {
+			return fmt.Errorf("invalid interval %q: %w", p.Interval, err)
+		}
+		if interval < time.Minute {
+			// Discord rate limits presence updates
+			return fmt.Errorf("interval %s is shorter than one minute", interval)
+		}
+		p.interval = interval
+	}
+	if len(p.Activities) > 1 && p.interval == 0 {
+		return errors.New("an interval is required to rotate multiple activities")
+	}
+
+	return nil
+}
+
+// statusData returns the presence update for the activity at the given rotation index
+func (p presence) statusData(index int) discordgo.UpdateStatusData {
+	data := discordgo.UpdateStatusData{
+		Activities: []*discordgo.Activity{},
+		Status:     p.Status,
+	}
+
+	if len(p.Activities) > 0 {
+		activity := p.Activities[index%len(p.Activities)]
+		data.Activities = append(data.Activities, &discordgo.Activity{
+			Name: activity.Name,
+			Type: presenceActivityTypes[activity.Type],
+			URL:  activity.URL,
+		})
+	}
+
+	return data
+}
+
+// botPresences are the presences per bot ID, configured as JSON, for example
+// {"123":{"status":"idle","activities":[{"type":"watching","name":"you"},{"type":"game","name":".help"}],"interval":"5m"}}
+type botPresences map[string]presence
+
+// Decode implements envconfig.Decoder, it fails on invalid presences
+func (b *botPresences) Decode(value string) error {
+	presences := make(botPresences)
+
+	err := json.Unmarshal([]byte(value), &presences)
+	if err != nil {
+		return err
+	}
+
+	for botID, p := range presences {
+		err = p.validate()
+		if err != nil {
+			return fmt.Errorf("invalid presence for bot %s: %w", botID, err)
+		}
+		presences[botID] = p
+	}
+
+	*b = presences
+	return nil
+}
+
+// Get returns the presence for a bot, or the default presence if none is configured
+func (b botPresences) Get(botID string) presence {
+	p, ok := b[botID]
+	if !ok {
+		return defaultPresence
+	}
+
+	return p
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	"gitlab.com/Cacophony/Gateway/pkg/dispatch"
+	"gitlab.com/Cacophony/Gateway/pkg/handler"
+	"gitlab.com/Cacophony/Gateway/pkg/publisher"
+	"gitlab.com/Cacophony/Gateway/pkg/recording"
+	"gitlab.com/Cacophony/Gateway/pkg/routing"
+	"gitlab.com/Cacophony/Gateway/pkg/rules"
+	"gitlab.com/Cacophony/Gateway/pkg/whitelist"
+	"gitlab.com/Cacophony/go-kit/logging"
+	"gitlab.com/Cacophony/go-kit/state"
+	"go.uber.org/zap"
+)
+
+// replay feeds a recording through the event handler, see RECORD_FILE,
+// using a local Redis for state and deduplication, and publishing to memory.
+//
+//	gateway replay [-speed 10] [-print] recording.jsonl.gz
+func replay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	redisAddress := flags.String("redis", "localhost:6379", "address of the Redis server to use for state")
+	redisPassword := flags.String("redis-password", "", "password of the Redis server")
+	speed := flags.Float64("speed", 1, "replay speed relative to the recording, 0 replays as fast as possible")
+	deduplicate := flags.Bool("deduplicate", false, "deduplicate events")
+	whitelistEnabled := flags.Bool("whitelist", false, "only publish events of whitelisted guilds")
+	rulesEnabled := flags.Bool("rules", false, "apply the rules stored in Redis")
+	rawPassthrough := flags.Bool("raw", false, "publish dispatches unknown to the events package as raw events")
+	routesFile := flags.String("routes", "", "routing table to apply, see ROUTES_FILE")
+	printEvents := flags.Bool("print", false, "print the published events to stdout, one per line")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || *speed < 0 {
+		flags.Usage()
+		return errors.New("usage: gateway replay [flags] <recording>")
+	}
+
+	logger, err := logging.NewLogger(
+		logging.DevelopmentEnvironment,
+		ServiceName,
+		"",
+		&http.Client{
+			Timeout: 10 * time.Second,
+		},
+	)
+	if err != nil {
+		return errors.Wrap(err, "unable to initialise logger")
+	}
+	defer logger.Sync() // nolint: errcheck
+
+	redisClient := redis.NewClient(&redis.Options{
+		Addr:     *redisAddress,
+		Password: *redisPassword,
+	})
+	defer redisClient.Close() // nolint: errcheck
+	_, err = redisClient.Ping().Result()
+	if err != nil {
+		return errors.Wrap(err, "unable to connect to redis")
+	}
+
+	checker := whitelist.NewChecker(
+		redisClient,
+		logger,
+		time.Minute,
+		*whitelistEnabled,
+	)
+	err = checker.Start()
+	if err != nil {
+		return errors.Wrap(err, "unable to initialise whitelist checker")
+	}
+
+	var filter handler.Filter
+	if *rulesEnabled {
+		ruleEngine := rules.NewEngine(redisClient, logger, time.Minute)
+		err = ruleEngine.Start()
+		if err != nil {
+			return errors.Wrap(err, "unable to initialise rules")
+		}
+		filter = ruleEngine
+	}
+
+	var routes *routing.Table
+	if *routesFile != "" {
+		routes, err = routing.Load(*routesFile)
+		if err != nil {
+			return errors.Wrap(err, "unable to load routing table")
+		}
+	}
+
+	memoryPublisher := publisher.NewMemory()
+	// events are handled synchronously, so replays are deterministic
+	eventHandler := handler.NewEventHandler(
+		logger.With(zap.String("feature", "EventHandler")),
+		handler.NewRedisDeduplicator(redisClient),
+		memoryPublisher,
+		checker,
+		filter,
+		state.NewState(redisClient, nil),
+		*deduplicate,
+		// members are never requested, the replay ends before
+		time.Hour,
+		nil,
+		routes,
+		nil,
+	)
+	if *rawPassthrough {
+		eventHandler.EnableRawPassthrough()
+	}
+
+	reader, err := recording.Open(flags.Arg(0))
+	if err != nil {
+		return errors.Wrap(err, "unable to open recording")
+	}
+	defer reader.Close() // nolint: errcheck
+
+	sessions := make(map[string]*discordgo.Session)
+	var replayed int
+	var first time.Time
+	start := time.Now()
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.Warn("unable to read recording, stopping replay", zap.Error(err))
+			break
+		}
+
+		if *speed > 0 {
+			if first.IsZero() {
+				first = record.ReceivedAt
+			}
+			due := time.Duration(float64(record.ReceivedAt.Sub(first)) / *speed)
+			time.Sleep(due - time.Since(start))
+		}
+
+		eventHandler.OnDiscordEvent(replaySession(sessions, record), replayEvent(record))
+		replayed++
+	}
+	eventHandler.Close()
+
+	published := memoryPublisher.Messages()
+	if *printEvents {
+		for _, message := range published {
+			fmt.Fprintln(os.Stdout, string(message.Body))
+		}
+	}
+
+	logger.Info("replayed recording",
+		zap.Int("dispatches", replayed),
+		zap.Int("published", len(published)),
+		zap.Any("published_by_type", countTypes(published)),
+		zap.Duration("duration", time.Since(start)),
+	)
+
+	return nil
+}
+
+// replaySession returns a disconnected session for the bot and shard of a record, sessions are reused
+func replaySession(sessions map[string]*discordgo.Session, record *recording.Record) *discordgo.Session {
+	key := record.BotID + ":" + strconv.Itoa(record.ShardID)
+
+	session, ok := sessions[key]
+	if !ok {
+		session = &discordgo.Session{
+			State:      discordgo.NewState(),
+			ShardID:    record.ShardID,
+			ShardCount: record.ShardCount,
+		}
+		session.State.User = &discordgo.User{ID: record.BotID}
+		sessions[key] = session
+	}
+
+	return session
+}
+
+// replayEvent decodes a record into a raw event like discordgo does, unknown dispatch types are kept raw only
+func replayEvent(record *recording.Record) *discordgo.Event {
+	event := &discordgo.Event{
+		Sequence: record.Sequence,
+		Type:     record.Type,
+		RawData:  record.Payload,
+	}
+
+	item, err := dispatch.Decode(record.Type, record.Payload)
+	if err == nil {
+		event.Struct = item
+	}
+
+	return event
+}
+
+func countTypes(messages []publisher.Message) map[string]int {
+	counts := make(map[string]int)
+	for _, message := range messages {
+		var event struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal(message.Body, &event) // nolint: errcheck
+		counts[event.Type]++
+	}
+
+	return counts
+}
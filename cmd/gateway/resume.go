@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/bwmarrin/discordgo"
+	"gitlab.com/Cacophony/Gateway/pkg/resume"
+)
+
+// resumeTracker keeps track of the session ID, resume gateway URL, and last sequence number of a shard session
+type resumeTracker struct {
+	lock  sync.Mutex
+	state resume.State
+
+	// started receives the type of READY and RESUMED dispatches, see awaitStart
+	started chan string
+}
+
+type readyResume struct {
+	SessionID        string `json:"session_id"`
+	ResumeGatewayURL string `json:"resume_gateway_url"`
+}
+
+func newResumeTracker(state *resume.State) *resumeTracker {
+	t := &resumeTracker{
+		started: make(chan string, 1),
+	}
+	if state != nil {
+		t.state = *state
+	}
+
+	return t
+}
+
+// onEvent receives all raw gateway dispatches of the session
+func (t *resumeTracker) onEvent(_ *discordgo.Session, event *discordgo.Event) {
+	if event == nil || event.Operation != 0 {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// discordgo does not expose the resume gateway URL, so we read it from the raw READY payload
+	if event.Type == "READY" {
+		var ready readyResume
+		if err := json.Unmarshal(event.RawData, &ready); err == nil {
+			t.state.SessionID = ready.SessionID
+			t.state.ResumeGatewayURL = ready.ResumeGatewayURL
+			t.state.Sequence = event.Sequence
+		}
+	}
+
+	// the sequence never goes backwards, even if dispatches are received out of order
+	if event.Sequence > t.state.Sequence {
+		t.state.Sequence = event.Sequence
+	}
+	t.state.UpdatedAt = time.Now().UTC()
+
+	if event.Type == "READY" || event.Type == "RESUMED" {
+		select {
+		case <-t.started:
+		default:
+		}
+		t.started <- event.Type
+	}
+}
+
+// awaitStart waits for the session to be started by a READY or RESUMED dispatch received after clearStart,
+// and returns its type, or an empty string after the timeout
+func (t *resumeTracker) awaitStart(timeout time.Duration) string {
+	select {
+	case dispatchType := <-t.started:
+		return dispatchType
+	case <-time.After(timeout):
+		return ""
+	}
+}
+
+// clearStart forgets READY and RESUMED dispatches received before
+func (t *resumeTracker) clearStart() {
+	select {
+	case <-t.started:
+	default:
+	}
+}
+
+// State returns a copy of the current resume state
+func (t *resumeTracker) State() *resume.State {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	state := t.state
+	return &state
+}
+
+// SessionID returns the current gateway session ID, it implements handler.SessionTracker
+func (t *resumeTracker) SessionID() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.state.SessionID
+}
+
+// Reset forgets the resume state, after Discord rejected resuming the session
+func (t *resumeTracker) Reset() {
+	t.lock.Lock()
+	t.state = resume.State{}
+	t.lock.Unlock()
+}
+
+// sessionFields are the unexported fields of discordgo sessions which have to be set to resume a session,
+// or guard the heartbeat measurements, discordgo does not expose them, see checkSessionFields
+var sessionFields = map[string]reflect.Type{
+	"sessionID": reflect.TypeOf(""),
+	"gateway":   reflect.TypeOf(""),
+	"sequence":  reflect.TypeOf((*int64)(nil)),
+	"wsMutex":   reflect.TypeOf(sync.Mutex{}),
+}
+
+// checkSessionFields makes sure discordgo sessions still have the unexported fields the gateway depends on,
+// it is called on startup, so a discordgo upgrade which changes them fails loudly instead of breaking resumes
+func checkSessionFields() error {
+	sessionType := reflect.TypeOf(discordgo.Session{})
+	for name, fieldType := range sessionFields {
+		field, ok := sessionType.FieldByName(name)
+		if !ok || field.Type != fieldType {
+			return fmt.Errorf("discordgo session has no field %s of type %s", name, fieldType)
+		}
+	}
+
+	return nil
+}
+
+// restoreSession prepares a discordgo session to send a RESUME instead of an IDENTIFY on Open,
+// discordgo does not expose the session ID, sequence, and gateway URL, so we have to set them directly
+func restoreSession(discordSession *discordgo.Session, state *resume.State) error {
+	gateway := ""
+	if state.ResumeGatewayURL != "" {
+		gateway = state.ResumeGatewayURL
+		if !strings.HasSuffix(gateway, "/") {
+			gateway += "/"
+		}
+		gateway += "?v=" + discordgo.APIVersion + "&encoding=json"
+	}
+
+	err := checkSessionFields()
+	if err != nil {
+		return err
+	}
+
+	sessionField(discordSession, "sessionID").SetString(state.SessionID)
+	sessionField(discordSession, "gateway").SetString(gateway)
+	sequence := sessionField(discordSession, "sequence").Interface().(*int64)
+	if sequence == nil {
+		return fmt.Errorf("discordgo session has no sequence")
+	}
+	atomic.StoreInt64(sequence, state.Sequence)
+
+	return nil
+}
+
+// resetSession clears a restored resume state, so the discordgo session sends an IDENTIFY on Open
+func resetSession(discordSession *discordgo.Session) error {
+	return restoreSession(discordSession, &resume.State{})
+}
+
+// sessionField returns a settable unexported field of a discordgo session, it must be checked by checkSessionFields
+func sessionField(discordSession *discordgo.Session, name string) reflect.Value {
+	field := reflect.ValueOf(discordSession).Elem().FieldByName(name)
+
+	return reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem()
+}
@@ -0,0 +1,12 @@
+package main
+
+import "testing"
+
+// TestSessionFields fails when a discordgo upgrade renames or changes the unexported session fields
+// the gateway resumes sessions and samples heartbeats with
+func TestSessionFields(t *testing.T) {
+	err := checkSessionFields()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
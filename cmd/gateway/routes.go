@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"gitlab.com/Cacophony/Gateway/pkg/deadletter"
+	"gitlab.com/Cacophony/Gateway/pkg/handler"
+	"go.uber.org/zap"
+)
+
+// registerRoutes adds the gateway specific endpoints to the router,
+// admin endpoints are only available if an admin token is configured
+func registerRoutes(
+	router chi.Router,
+	logger *zap.Logger,
+	adminToken string,
+	sessions *sessionManager,
+	bots *botRegistry,
+	eventHandler *handler.EventHandler,
+	deadLetters *deadletter.Queue,
+) {
+	if adminToken == "" {
+		logger.Warn("no admin token configured, admin endpoints are disabled")
+		return
+	}
+
+	router.Route("/admin", func(r chi.Router) {
+		r.Use(requireToken(adminToken))
+
+		r.Get("/sessions", func(w http.ResponseWriter, _ *http.Request) {
+			writeJSON(w, logger, http.StatusOK, sessions.Statuses())
+		})
+
+		r.Post("/bots", func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				BotID    string    `json:"bot_id"`
+				Token    string    `json:"token"`
+				Intents  string    `json:"intents"`
+				Presence *presence `json:"presence"`
+			}
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if body.BotID == "" || body.Token == "" {
+				http.Error(w, "bot_id and token are required", http.StatusBadRequest)
+				return
+			}
+
+			intents := defaultIntents
+			if body.Intents != "" {
+				intents, err = parseIntents(body.Intents)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+
+			p := defaultPresence
+			if body.Presence != nil {
+				p = *body.Presence
+				err = p.validate()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+
+			err = bots.AddRuntime(body.BotID, body.Token, intents, p)
+			if err == errBotAlreadyRegistered || err == errBotsCoordinated {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			logger.Info("added bot", zap.String("bot_id", body.BotID))
+			w.WriteHeader(http.StatusAccepted)
+		})
+
+		r.Delete("/bots/{botID}", func(w http.ResponseWriter, r *http.Request) {
+			botID := chi.URLParam(r, "botID")
+
+			err := bots.RemoveRuntime(botID)
+			if err == errBotNotRegistered {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err == errBotsCoordinated {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			logger.Info("removed bot", zap.String("bot_id", botID))
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		// reconnects a shard, add ?resume=true to resume the current session instead of identifying again
+		r.Post("/bots/{botID}/shards/{shardID}/reconnect", func(w http.ResponseWriter, r *http.Request) {
+			botID := chi.URLParam(r, "botID")
+			shardID, err := strconv.Atoi(chi.URLParam(r, "shardID"))
+			if err != nil {
+				http.Error(w, "invalid shard ID", http.StatusBadRequest)
+				return
+			}
+			resumeSession := r.URL.Query().Get("resume") == "true"
+
+			err = sessions.ReconnectShard(botID, shardID, resumeSession)
+			if err == errBotNotRegistered || err == errShardNotRunning {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			logger.Info("requested shard reconnect",
+				zap.String("bot_id", botID),
+				zap.Int("shard_id", shardID),
+				zap.Bool("resume", resumeSession),
+			)
+			w.WriteHeader(http.StatusAccepted)
+		})
+
+		r.Get("/bots/{botID}/presence", func(w http.ResponseWriter, r *http.Request) {
+			p, ok := sessions.Presence(chi.URLParam(r, "botID"))
+			if !ok {
+				http.Error(w, errBotNotRegistered.Error(), http.StatusNotFound)
+				return
+			}
+
+			writeJSON(w, logger, http.StatusOK, p)
+		})
+
+		r.Put("/bots/{botID}/presence", func(w http.ResponseWriter, r *http.Request) {
+			var p presence
+			err := json.NewDecoder(r.Body).Decode(&p)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			botID := chi.URLParam(r, "botID")
+			err = sessions.SetPresence(botID, p)
+			if err == errBotNotRegistered {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			logger.Info("updated presence", zap.String("bot_id", botID))
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		if deadLetters != nil {
+			r.Route("/dead-letters", deadLetterRoutes(logger, deadLetters, eventHandler))
+		}
+	})
+}
+
+// requireToken rejects requests without the given bearer token
+func requireToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, logger *zap.Logger, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		logger.Error("unable to write response", zap.Error(err))
+	}
+}
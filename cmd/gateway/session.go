@@ -1,71 +1,146 @@
 package main
 
 import (
+	"time"
+
 	"github.com/bwmarrin/discordgo"
 	"gitlab.com/Cacophony/Gateway/pkg/handler"
-	"gitlab.com/Cacophony/go-kit/logging"
+	"gitlab.com/Cacophony/Gateway/pkg/resume"
 	"go.uber.org/zap"
 )
 
+// sessionStartTimeout is the time to wait for the READY or RESUMED dispatch after resuming a session,
+// Discord replays all missed dispatches before the RESUMED
+const sessionStartTimeout = 30 * time.Second
+
+// NewSession creates the discordgo session for a single shard of a bot, it does not connect it
 func NewSession(
-	logger *zap.Logger,
+	botID string,
 	token string,
+	shardID int,
+	shardCount int,
+	intents discordgo.Intent,
 	eventHandler *handler.EventHandler,
-	closeChannel chan interface{},
-) {
-	// init discordgo session
-	discordgo.Logger = logging.DiscordgoLogger(
-		logger.With(zap.String("feature", "discordgo")),
-	)
-
+	tracker *resumeTracker,
+) (*discordgo.Session, error) {
 	discordSession, err := discordgo.New("Bot " + token)
 	if err != nil {
-		logger.Fatal("unable to initialise discord session",
-			zap.Error(err),
-		)
+		return nil, err
 	}
 	discordSession.LogLevel = discordgo.LogInformational
 	discordSession.StateEnabled = false
+	// the event handler needs the bot user before a READY is received, which does not happen on resumed sessions,
+	// the READY replaces it with the actual user of the token
+	discordSession.State.User = &discordgo.User{ID: botID}
+	discordSession.ShardID = shardID
+	discordSession.ShardCount = shardCount
+	// reconnecting is handled by the supervisor
+	discordSession.ShouldReconnectOnError = false
+	// the event handler keeps events in order, and handles them concurrently itself
+	discordSession.SyncEvents = true
 
-	discordSession.AddHandler(eventHandler.OnDiscordEvent)
+	discordSession.AddHandler(tracker.onEvent)
+	discordSession.AddHandler(eventHandler.HandlerFor(tracker))
 
 	// sets the necessary gateway intents https://discord.com/developers/docs/topics/gateway#gateway-intents
-	discordSession.Identify.Intents = discordgo.MakeIntent(
-		discordgo.IntentsAllWithoutPrivileged |
-			discordgo.IntentsGuildMembers,
-	)
+	discordSession.Identify.Intents = discordgo.MakeIntent(intents)
+
+	return discordSession, nil
+}
 
-	// start discord session
-	err = discordSession.Open()
+// openSession connects a discordgo session to the Discord Gateway,
+// if a resumable state is given it attempts to RESUME the session first, and only IDENTIFYs if that fails
+func openSession(
+	logger *zap.Logger,
+	discordSession *discordgo.Session,
+	tracker *resumeTracker,
+	resumeState *resume.State,
+	waitIdentify func() error,
+) error {
+	// if Discord rejects a RESUME with an Invalid Session, discordgo IDENTIFYs on its own right away,
+	// so resuming has to wait for an identify slot as well
+	err := waitIdentify()
 	if err != nil {
-		logger.Fatal("unable to start discord session",
+		return err
+	}
+
+	if resumeState.Resumable() {
+		tracker.clearStart()
+		err = restoreSession(discordSession, resumeState)
+		if err == nil {
+			err = discordSession.Open()
+		}
+		if err == nil {
+			switch tracker.awaitStart(sessionStartTimeout) {
+			case "RESUMED":
+				logger.Info("resumed discord session",
+					zap.String("session_id", resumeState.SessionID),
+					zap.Int64("sequence", resumeState.Sequence),
+				)
+			case "READY":
+				logger.Warn("discord invalidated the session, identified instead",
+					zap.String("session_id", resumeState.SessionID),
+					zap.Int64("sequence", resumeState.Sequence),
+				)
+			default:
+				logger.Warn("discord neither resumed the session nor identified in time",
+					zap.String("session_id", resumeState.SessionID),
+					zap.Int64("sequence", resumeState.Sequence),
+				)
+			}
+			return nil
+		}
+		if isFatalCloseError(err) {
+			return err
+		}
+
+		logger.Warn("unable to resume discord session, identifying instead",
 			zap.Error(err),
 		)
+
+		tracker.Reset()
+		err = resetSession(discordSession)
+		if err != nil {
+			return err
+		}
+
+		// the failed attempt might have identified already
+		err = waitIdentify()
+		if err != nil {
+			return err
+		}
 	}
 
-	logger.Info("connected Bot to Discord Gateway")
-
-	err = discordSession.UpdateStatusComplex(discordgo.UpdateStatusData{
-		Activities: []*discordgo.Activity{
-			{
-				Name: ".help",
-				Type: discordgo.ActivityTypeGame,
-			},
-		},
-		Status: "online",
-	})
+	return discordSession.Open()
+}
+
+// updatePresence sets the presence of a connected session
+func updatePresence(logger *zap.Logger, discordSession *discordgo.Session, data discordgo.UpdateStatusData) {
+	err := discordSession.UpdateStatusComplex(data)
 	if err != nil {
 		logger.Error("failure updating status", zap.Error(err))
 	}
+}
 
-	go func() {
-		<-closeChannel
-		err := discordSession.Close()
-		if err != nil {
-			logger.Fatal("unable to close discord session",
-				zap.Error(err),
-			)
-		}
-		closeChannel <- true
-	}()
+// gatewayBot retrieves the recommended shard count and identify concurrency for the given token,
+// the endpoint respects DISCORD_API_BASE, see discord.SetAPIBase
+func gatewayBot(token string) (*discordgo.GatewayBotResponse, error) {
+	discordSession, err := discordgo.New("Bot " + token)
+	if err != nil {
+		return nil, err
+	}
+
+	gateway, err := discordSession.GatewayBot()
+	if err != nil {
+		return nil, err
+	}
+
+	if gateway.Shards < 1 {
+		gateway.Shards = 1
+	}
+	if gateway.SessionStartLimit.MaxConcurrency < 1 {
+		gateway.SessionStartLimit.MaxConcurrency = 1
+	}
+
+	return gateway, nil
 }
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	raven "github.com/getsentry/raven-go"
+	"github.com/gorilla/websocket"
+	"gitlab.com/Cacophony/Gateway/pkg/resume"
+	"go.uber.org/zap"
+)
+
+const (
+	reconnectBackoffBase = time.Second
+	reconnectBackoffMax  = 2 * time.Minute
+
+	// heartbeatSampleInterval is the interval at which heartbeat measurements of connected sessions are cached
+	heartbeatSampleInterval = 5 * time.Second
+
+	// https://discord.com/developers/docs/topics/opcodes-and-status-codes#gateway-gateway-close-event-codes
+	closeAuthenticationFailed = 4004
+	closeDisallowedIntents    = 4014
+)
+
+// sessionState is the connection state of a shard, or of a bot
+type sessionState string
+
+const (
+	sessionStateConnecting   sessionState = "connecting"
+	sessionStateConnected    sessionState = "connected"
+	sessionStateReconnecting sessionState = "reconnecting"
+	sessionStateStopped      sessionState = "stopped"
+	sessionStateFailed       sessionState = "failed"
+)
+
+// sessionStateSeverity orders states from healthy to unhealthy
+var sessionStateSeverity = map[sessionState]int{
+	sessionStateStopped:      0,
+	sessionStateConnected:    1,
+	sessionStateConnecting:   2,
+	sessionStateReconnecting: 3,
+	sessionStateFailed:       4,
+}
+
+// ShardStatus is the connection status of a single shard
+type ShardStatus struct {
+	ShardID          int          `json:"shard_id"`
+	State            sessionState `json:"state"`
+	Error            string       `json:"error,omitempty"`
+	Attempts         int          `json:"attempts"`
+	Since            time.Time    `json:"since"`
+	LatencyMS        int64        `json:"latency_ms"`
+	LastHeartbeatAck time.Time    `json:"last_heartbeat_ack"`
+}
+
+// HeartbeatAckAge returns the time since Discord last acknowledged a heartbeat of the shard
+func (s ShardStatus) HeartbeatAckAge() time.Duration {
+	if s.LastHeartbeatAck.IsZero() {
+		return 0
+	}
+
+	return time.Since(s.LastHeartbeatAck)
+}
+
+// supervisor keeps a single shard session connected,
+// it reconnects with exponential backoff, and stops retrying once its bot's circuit breaker opens
+type supervisor struct {
+	logger       *zap.Logger
+	bot          *bot
+	session      *discordgo.Session
+	tracker      *resumeTracker
+	resumeState  *resume.State
+	waitIdentify func() error
+	closeCode    int
+
+	statusLock sync.RWMutex
+	status     ShardStatus
+
+	disconnected chan interface{}
+	reconnect    chan bool
+	firstAttempt chan error
+	stop         chan interface{}
+	done         chan interface{}
+}
+
+func newSupervisor(
+	logger *zap.Logger,
+	b *bot,
+	shardID int,
+	discordSession *discordgo.Session,
+	tracker *resumeTracker,
+	resumeState *resume.State,
+	waitIdentify func() error,
+	closeCode int,
+) *supervisor {
+	s := &supervisor{
+		logger:       logger,
+		bot:          b,
+		session:      discordSession,
+		tracker:      tracker,
+		resumeState:  resumeState,
+		waitIdentify: waitIdentify,
+		closeCode:    closeCode,
+		status: ShardStatus{
+			ShardID: shardID,
+			State:   sessionStateConnecting,
+			Since:   time.Now().UTC(),
+		},
+		disconnected: make(chan interface{}, 1),
+		reconnect:    make(chan bool, 1),
+		firstAttempt: make(chan error, 1),
+		stop:         make(chan interface{}),
+		done:         make(chan interface{}),
+	}
+
+	discordSession.AddHandler(func(_ *discordgo.Session, _ *discordgo.Disconnect) {
+		select {
+		case s.disconnected <- nil:
+		default:
+		}
+	})
+	discordSession.AddHandler(s.onReady)
+
+	return s
+}
+
+// Start starts supervising the session, it returns once the first connection attempt has been made,
+// an error is only returned if the bot's circuit breaker is open, other failures are retried in the background
+func (s *supervisor) Start() error {
+	go s.run()
+
+	return <-s.firstAttempt
+}
+
+// Stop closes the session, and stops reconnecting it
+func (s *supervisor) Stop() error {
+	close(s.stop)
+	<-s.done
+
+	s.setStatus(sessionStateStopped, nil)
+
+	return s.session.CloseWithCode(s.closeCode)
+}
+
+// Reconnect forces a new connection of the shard, resuming the current session if resumeSession is set,
+// if the shard is waiting to reconnect, it reconnects right away
+func (s *supervisor) Reconnect(resumeSession bool) {
+	select {
+	case s.reconnect <- resumeSession:
+	default:
+	}
+}
+
+// Status returns the current connection status of the shard, heartbeats are sampled every heartbeatSampleInterval
+func (s *supervisor) Status() ShardStatus {
+	s.statusLock.RLock()
+	status := s.status
+	s.statusLock.RUnlock()
+
+	return status
+}
+
+// sampleHeartbeat caches the heartbeat measurements of the session for Status,
+// it skips sampling while the session is locked, as Open holds the lock while connecting.
+// discordgo sets the time a heartbeat is sent while holding the websocket lock only, so that is held as well.
+func (s *supervisor) sampleHeartbeat() {
+	if !s.session.TryRLock() {
+		return
+	}
+	wsLock := sessionField(s.session, "wsMutex").Addr().Interface().(*sync.Mutex)
+	if !wsLock.TryLock() {
+		s.session.RUnlock()
+		return
+	}
+	lastAck := s.session.LastHeartbeatAck
+	lastSent := s.session.LastHeartbeatSent
+	wsLock.Unlock()
+	s.session.RUnlock()
+
+	latency := lastAck.Sub(lastSent).Milliseconds()
+	if latency < 0 {
+		// the last heartbeat has not been acknowledged yet
+		latency = 0
+	}
+
+	s.statusLock.Lock()
+	s.status.LastHeartbeatAck = lastAck
+	s.status.LatencyMS = latency
+	s.statusLock.Unlock()
+}
+
+func (s *supervisor) run() {
+	defer close(s.done)
+
+	var attempt int
+	first := true
+	for {
+		// drop disconnects from previous connections
+		select {
+		case <-s.disconnected:
+		default:
+		}
+
+		err := s.connect()
+		if first {
+			first = false
+			s.firstAttempt <- s.bot.tripped()
+		}
+
+		if err == nil && s.bot.tripped() == nil {
+			attempt = 0
+			s.setStatus(sessionStateConnected, nil)
+			s.logger.Info("connected Bot to Discord Gateway")
+
+			updatePresence(s.logger, s.session, s.bot.statusData())
+			s.sampleHeartbeat()
+
+			if s.waitConnected() {
+				return
+			}
+
+			s.setStatus(sessionStateReconnecting, nil)
+			continue
+		}
+
+		if s.bot.tripped() != nil {
+			// the session might have been connected with the token of another user, see onReady
+			err = s.session.CloseWithCode(websocket.CloseNormalClosure)
+			if err != nil {
+				s.logger.Warn("unable to close discord session", zap.Error(err))
+			}
+
+			s.setStatus(sessionStateFailed, s.bot.tripped())
+			return
+		}
+
+		raven.CaptureError(err, nil)
+		s.logger.Error("unable to connect to Discord Gateway, retrying",
+			zap.Error(err),
+			zap.Int("attempt", attempt),
+		)
+		s.setStatus(sessionStateReconnecting, err)
+
+		select {
+		case <-s.stop:
+			return
+		case resumeSession := <-s.reconnect:
+			s.logger.Info("forced reconnect", zap.Bool("resume", resumeSession))
+			s.forceReconnect(resumeSession)
+		case <-time.After(backoff(attempt)):
+		}
+		attempt++
+	}
+}
+
+// waitConnected samples heartbeats until the session is disconnected, a reconnect is forced, or the supervisor is
+// stopped, it returns true if the supervisor has been stopped
+func (s *supervisor) waitConnected() bool {
+	ticker := time.NewTicker(heartbeatSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return true
+		case <-s.disconnected:
+			s.logger.Warn("disconnected from Discord Gateway, reconnecting")
+			return false
+		case resumeSession := <-s.reconnect:
+			s.logger.Info("forced reconnect", zap.Bool("resume", resumeSession))
+			s.forceReconnect(resumeSession)
+			return false
+		case <-ticker.C:
+			s.sampleHeartbeat()
+		}
+	}
+}
+
+func (s *supervisor) connect() error {
+	if err := s.bot.tripped(); err != nil {
+		return err
+	}
+
+	s.statusLock.Lock()
+	s.status.Attempts++
+	s.statusLock.Unlock()
+
+	// the initial connection may resume a persisted session,
+	// later reconnects are resumed by discordgo, as it keeps the session ID and sequence
+	resumeState := s.resumeState
+	s.resumeState = nil
+
+	err := openSession(s.logger, s.session, s.tracker, resumeState, s.waitIdentify)
+	if err == nil {
+		return nil
+	}
+
+	if isFatalCloseError(err) {
+		s.bot.trip(err)
+
+		s.logger.Error("Discord rejected the connection, giving up on bot",
+			zap.Error(err),
+		)
+		return err
+	}
+
+	// the session might not be resumable anymore, so identify on the next attempt
+	if resetErr := resetSession(s.session); resetErr != nil {
+		s.logger.Error("unable to reset discord session", zap.Error(resetErr))
+	}
+	s.tracker.Reset()
+
+	return err
+}
+
+// onReady makes sure the token belongs to the configured bot, and opens the circuit breaker of the bot otherwise.
+// The READY might be handled by Open, which holds the session lock, so the session is closed by run instead.
+func (s *supervisor) onReady(_ *discordgo.Session, ready *discordgo.Ready) {
+	if ready.User == nil || ready.User.ID == s.bot.id {
+		return
+	}
+
+	err := fmt.Errorf("token belongs to user %s, not to bot %s", ready.User.ID, s.bot.id)
+	s.bot.trip(err)
+	s.logger.Error("token does not match the bot ID, giving up on bot", zap.Error(err))
+
+	select {
+	case s.disconnected <- nil:
+	default:
+	}
+}
+
+// forceReconnect closes the current connection, and forgets the session unless it should be resumed
+func (s *supervisor) forceReconnect(resumeSession bool) {
+	closeCode := websocket.CloseServiceRestart
+	if !resumeSession {
+		closeCode = websocket.CloseNormalClosure
+	}
+
+	err := s.session.CloseWithCode(closeCode)
+	if err != nil {
+		s.logger.Warn("unable to close discord session", zap.Error(err))
+	}
+
+	if resumeSession {
+		return
+	}
+
+	err = resetSession(s.session)
+	if err != nil {
+		s.logger.Error("unable to reset discord session", zap.Error(err))
+	}
+	s.tracker.Reset()
+}
+
+func (s *supervisor) setStatus(state sessionState, err error) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+
+	if s.status.State != state {
+		s.status.Since = time.Now().UTC()
+	}
+	s.status.State = state
+	s.status.Error = ""
+	if err != nil {
+		s.status.Error = err.Error()
+	}
+}
+
+// backoff returns the time to wait before the given reconnect attempt, exponential with full jitter
+func backoff(attempt int) time.Duration {
+	max := reconnectBackoffMax
+	if attempt < 16 && reconnectBackoffBase<<uint(attempt) < max {
+		max = reconnectBackoffBase << uint(attempt)
+	}
+
+	return time.Duration(rand.Int63n(int64(max))) + reconnectBackoffBase
+}
+
+// isFatalCloseError returns true if Discord closed the connection with a close code that will not be resolved by retrying
+func isFatalCloseError(err error) bool {
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		return false
+	}
+
+	return closeErr.Code == closeAuthenticationFailed ||
+		closeErr.Code == closeDisallowedIntents
+}
@@ -17,6 +17,7 @@
 # DEDUPLICATE
 # REQUEST_MEMBERS_DELAY
 # HONEYCOMB_API_KEY
+# ADMIN_TOKEN
 
 template="k8s/manifest.tmpl.yaml"
 target="k8s/manifest.yaml"
@@ -38,3 +39,4 @@ sed -i -e "s|{{DISCORD_API_BASE}}|$DISCORD_API_BASE|g" "$target"
 sed -i -e "s|{{DEDUPLICATE}}|$DEDUPLICATE|g" "$target"
 sed -i -e "s|{{REQUEST_MEMBERS_DELAY}}|$REQUEST_MEMBERS_DELAY|g" "$target"
 sed -i -e "s|{{HONEYCOMB_API_KEY}}|$HONEYCOMB_API_KEY|g" "$target"
+sed -i -e "s|{{ADMIN_TOKEN}}|$ADMIN_TOKEN|g" "$target"
@@ -0,0 +1,481 @@
+package coordinator
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/go-redis/redis"
+	"go.uber.org/zap"
+)
+
+const (
+	// identifyInterval is the time Discord requires between identifies of the same rate limit bucket
+	identifyInterval = 5 * time.Second
+
+	// pollInterval is the interval at which handovers are progressed
+	pollInterval = time.Second
+)
+
+// Shard identifies a single shard of a bot
+type Shard struct {
+	BotID string
+	ID    int
+}
+
+// Shards connects and disconnects shards on behalf of the Coordinator
+type Shards interface {
+	// StartShard connects a shard after its lease has been acquired
+	StartShard(botID string, shardID int) error
+	// TakeOverShard connects a shard which is still connected by another replica
+	TakeOverShard(botID string, shardID int) error
+	// StopShard disconnects a shard before its lease is released, and stores its session for resuming
+	StopShard(botID string, shardID int) error
+	// DropShard disconnects a shard whose session is resumed by another replica, after handing it over,
+	// losing its lease, or giving up taking it over, the stored session is left to the other replica
+	DropShard(botID string, shardID int) error
+	// SetOverlap is called while another replica might receive the same events for a shard
+	SetOverlap(botID string, shardID int, overlap bool)
+}
+
+// Coordinator leases shards of bots to gateway replicas using Redis,
+// so multiple replicas connect disjoint sets of shards.
+// Leases are renewed on every heartbeat, leases of dead replicas expire and are taken over by the remaining replicas.
+type Coordinator struct {
+	redis           *redis.Client
+	logger          *zap.Logger
+	replicaID       string
+	leaseTTL        time.Duration
+	interval        time.Duration
+	handoverTimeout time.Duration
+	shards          Shards
+
+	lock     sync.Mutex
+	bots     map[string]int
+	target   int
+	held     map[Shard]bool
+	starting map[Shard]bool
+	offered  map[Shard]time.Time
+	taking   map[Shard]time.Time
+
+	stop chan interface{}
+	done chan interface{}
+}
+
+// NewCoordinator creates a new Coordinator
+func NewCoordinator(
+	redis *redis.Client,
+	logger *zap.Logger,
+	replicaID string,
+	leaseTTL time.Duration,
+	handoverTimeout time.Duration,
+) *Coordinator {
+	return &Coordinator{
+		redis:           redis,
+		logger:          logger,
+		replicaID:       replicaID,
+		leaseTTL:        leaseTTL,
+		interval:        leaseTTL / 3,
+		handoverTimeout: handoverTimeout,
+		bots:            make(map[string]int),
+		held:            make(map[Shard]bool),
+		starting:        make(map[Shard]bool),
+		offered:         make(map[Shard]time.Time),
+		taking:          make(map[Shard]time.Time),
+		stop:            make(chan interface{}),
+		done:            make(chan interface{}),
+	}
+}
+
+// AddBot registers the shards of a bot to be distributed across replicas
+func (c *Coordinator) AddBot(botID string, shardCount int) {
+	c.lock.Lock()
+	c.bots[botID] = shardCount
+	c.lock.Unlock()
+}
+
+// RemoveBot stops distributing the shards of a bot, and releases all its shards held by this replica
+func (c *Coordinator) RemoveBot(botID string) {
+	c.lock.Lock()
+	delete(c.bots, botID)
+	var held, taking []Shard
+	for shard := range c.held {
+		if shard.BotID == botID {
+			held = append(held, shard)
+		}
+	}
+	for shard := range c.taking {
+		if shard.BotID == botID {
+			taking = append(taking, shard)
+			delete(c.taking, shard)
+		}
+	}
+	c.lock.Unlock()
+
+	for _, shard := range taking {
+		c.dropShard(shard)
+		c.redis.Del(claimKey(shard))
+	}
+	for _, shard := range held {
+		c.withdraw(shard)
+		c.release(shard)
+	}
+}
+
+// Start starts the heartbeat loop, which renews, acquires, hands over, and releases leases
+func (c *Coordinator) Start(shards Shards) {
+	c.shards = shards
+
+	go func() {
+		defer close(c.done)
+
+		var lastHeartbeat time.Time
+		for {
+			if time.Since(lastHeartbeat) >= c.interval {
+				err := c.heartbeat()
+				if err != nil {
+					raven.CaptureError(err, nil)
+					c.logger.Error("failed to coordinate shards", zap.Error(err))
+				}
+				lastHeartbeat = time.Now()
+			}
+
+			err := c.handover()
+			if err != nil {
+				raven.CaptureError(err, nil)
+				c.logger.Error("failed to hand over shards", zap.Error(err))
+			}
+
+			select {
+			case <-c.stop:
+				return
+			case <-time.After(pollInterval):
+			}
+		}
+	}()
+}
+
+// Stop stops the heartbeat loop, and hands over all shards held by this replica to other replicas.
+// Leases are renewed until their shards are handed over, shards which have not been taken over within the
+// handover timeout are disconnected, and their leases released.
+func (c *Coordinator) Stop() {
+	close(c.stop)
+	<-c.done
+
+	// deregister first, so other replicas make room for our shards
+	err := c.redis.ZRem(replicasKey, c.replicaID).Err()
+	if err != nil {
+		c.logger.Error("failed to deregister replica", zap.Error(err))
+	}
+
+	c.lock.Lock()
+	held := c.sortedHeld()
+	c.lock.Unlock()
+
+	for _, shard := range held {
+		c.offer(shard)
+	}
+
+	// the heartbeat loop is stopped, but the leases of shards which are not handed over yet must not expire,
+	// otherwise another replica might acquire them while they are still connected here
+	deadline := time.Now().Add(c.handoverTimeout)
+	lastRenew := time.Now()
+	for time.Now().Before(deadline) {
+		if time.Since(lastRenew) >= c.interval {
+			c.renew()
+			lastRenew = time.Now()
+		}
+
+		c.progressOffers(true)
+
+		c.lock.Lock()
+		pending := len(c.offered)
+		c.lock.Unlock()
+		if pending == 0 {
+			break
+		}
+
+		time.Sleep(pollInterval)
+	}
+
+	c.lock.Lock()
+	held = c.sortedHeld()
+	c.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, shard := range held {
+		wg.Add(1)
+		go func(shard Shard) {
+			defer wg.Done()
+
+			c.withdraw(shard)
+			c.release(shard)
+		}(shard)
+	}
+	wg.Wait()
+}
+
+// Held returns the shards currently leased by this replica
+func (c *Coordinator) Held() []Shard {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.sortedHeld()
+}
+
+// WaitIdentify blocks until the given rate limit bucket of a bot may identify, across all replicas
+func (c *Coordinator) WaitIdentify(botID string, bucket int) error {
+	for {
+		set, err := c.redis.SetNX(identifyKey(botID, bucket), c.replicaID, identifyInterval).Result()
+		if err != nil {
+			return err
+		}
+		if set {
+			return nil
+		}
+
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func (c *Coordinator) heartbeat() error {
+	now := time.Now()
+
+	// register this replica, and forget replicas which missed their heartbeats
+	err := c.redis.ZAdd(replicasKey, redis.Z{
+		Score:  float64(now.UnixNano()),
+		Member: c.replicaID,
+	}).Err()
+	if err != nil {
+		return err
+	}
+	err = c.redis.ZRemRangeByScore(
+		replicasKey,
+		"-inf",
+		strconv.FormatInt(now.Add(-c.leaseTTL).UnixNano(), 10),
+	).Err()
+	if err != nil {
+		return err
+	}
+	replicas, err := c.redis.ZCard(replicasKey).Result()
+	if err != nil {
+		return err
+	}
+	if replicas < 1 {
+		replicas = 1
+	}
+
+	c.renew()
+
+	c.lock.Lock()
+	var total int
+	for _, shardCount := range c.bots {
+		total += shardCount
+	}
+	c.target = (total + int(replicas) - 1) / int(replicas)
+	target := c.target
+	var keep []Shard
+	for _, shard := range c.sortedHeld() {
+		if _, offered := c.offered[shard]; !offered {
+			keep = append(keep, shard)
+		}
+	}
+	capacity := c.target - len(c.held) - len(c.taking)
+	c.lock.Unlock()
+
+	// hand over shards above our fair share, so new replicas can pick them up without a gap
+	for i := target; i < len(keep); i++ {
+		c.offer(keep[i])
+	}
+
+	if capacity > 0 {
+		return c.acquire(capacity)
+	}
+
+	return nil
+}
+
+// renew extends all leases held by this replica, and disconnects shards whose leases have been lost
+func (c *Coordinator) renew() {
+	c.lock.Lock()
+	held := c.sortedHeld()
+	c.lock.Unlock()
+
+	for _, shard := range held {
+		renewed, err := renewScript.Run(
+			c.redis,
+			[]string{leaseKey(shard.BotID, shard.ID)},
+			c.replicaID,
+			c.leaseTTL.Milliseconds(),
+		).Int()
+		if err != nil {
+			raven.CaptureError(err, nil)
+			c.logger.Error("failed to renew lease",
+				zap.Error(err),
+				zap.String("bot_id", shard.BotID),
+				zap.Int("shard_id", shard.ID),
+			)
+			continue
+		}
+		if renewed == 1 {
+			continue
+		}
+
+		c.logger.Warn("lost lease, disconnecting shard",
+			zap.String("bot_id", shard.BotID),
+			zap.Int("shard_id", shard.ID),
+		)
+
+		c.lock.Lock()
+		delete(c.held, shard)
+		c.lock.Unlock()
+
+		c.withdraw(shard)
+		c.dropShard(shard)
+	}
+}
+
+// acquire tries to lease up to count shards which are not leased by any replica
+func (c *Coordinator) acquire(count int) error {
+	c.lock.Lock()
+	var candidates []Shard
+	for botID, shardCount := range c.bots {
+		for shardID := 0; shardID < shardCount; shardID++ {
+			shard := Shard{BotID: botID, ID: shardID}
+			if _, taking := c.taking[shard]; taking || c.held[shard] || c.starting[shard] {
+				continue
+			}
+			candidates = append(candidates, shard)
+		}
+	}
+	c.lock.Unlock()
+	sortShards(candidates)
+
+	for _, shard := range candidates {
+		if count <= 0 {
+			break
+		}
+
+		set, err := c.redis.SetNX(leaseKey(shard.BotID, shard.ID), c.replicaID, c.leaseTTL).Result()
+		if err != nil {
+			return err
+		}
+		if !set {
+			continue
+		}
+		count--
+
+		c.logger.Info("acquired lease, connecting shard",
+			zap.String("bot_id", shard.BotID),
+			zap.Int("shard_id", shard.ID),
+		)
+
+		c.lock.Lock()
+		c.held[shard] = true
+		c.starting[shard] = true
+		c.lock.Unlock()
+
+		// connecting may wait for identify rate limits, so it must not block renewing leases
+		go c.start(shard)
+	}
+
+	return nil
+}
+
+func (c *Coordinator) start(shard Shard) {
+	err := c.shards.StartShard(shard.BotID, shard.ID)
+
+	c.lock.Lock()
+	delete(c.starting, shard)
+	held := c.held[shard]
+	c.lock.Unlock()
+
+	if err != nil {
+		raven.CaptureError(err, nil)
+		c.logger.Error("failed to connect shard, releasing lease",
+			zap.Error(err),
+			zap.String("bot_id", shard.BotID),
+			zap.Int("shard_id", shard.ID),
+		)
+		c.release(shard)
+		return
+	}
+
+	// the lease might have been lost while connecting
+	if !held {
+		c.dropShard(shard)
+	}
+}
+
+// release disconnects a shard held by this replica, and releases its lease
+func (c *Coordinator) release(shard Shard) {
+	c.lock.Lock()
+	delete(c.held, shard)
+	c.lock.Unlock()
+
+	c.stopShard(shard)
+
+	err := releaseScript.Run(
+		c.redis,
+		[]string{leaseKey(shard.BotID, shard.ID)},
+		c.replicaID,
+	).Err()
+	if err != nil && err != redis.Nil {
+		raven.CaptureError(err, nil)
+		c.logger.Error("failed to release lease",
+			zap.Error(err),
+			zap.String("bot_id", shard.BotID),
+			zap.Int("shard_id", shard.ID),
+		)
+		return
+	}
+
+	c.logger.Info("released lease",
+		zap.String("bot_id", shard.BotID),
+		zap.Int("shard_id", shard.ID),
+	)
+}
+
+func (c *Coordinator) stopShard(shard Shard) {
+	err := c.shards.StopShard(shard.BotID, shard.ID)
+	if err != nil {
+		c.logger.Error("failed to disconnect shard",
+			zap.Error(err),
+			zap.String("bot_id", shard.BotID),
+			zap.Int("shard_id", shard.ID),
+		)
+	}
+}
+
+func (c *Coordinator) dropShard(shard Shard) {
+	err := c.shards.DropShard(shard.BotID, shard.ID)
+	if err != nil {
+		c.logger.Error("failed to disconnect shard",
+			zap.Error(err),
+			zap.String("bot_id", shard.BotID),
+			zap.Int("shard_id", shard.ID),
+		)
+	}
+}
+
+// sortedHeld returns the held shards in a stable order, the caller must hold the lock
+func (c *Coordinator) sortedHeld() []Shard {
+	held := make([]Shard, 0, len(c.held))
+	for shard := range c.held {
+		held = append(held, shard)
+	}
+	sortShards(held)
+
+	return held
+}
+
+func sortShards(shards []Shard) {
+	sort.Slice(shards, func(i, j int) bool {
+		if shards[i].BotID != shards[j].BotID {
+			return shards[i].BotID < shards[j].BotID
+		}
+		return shards[i].ID < shards[j].ID
+	})
+}
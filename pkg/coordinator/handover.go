@@ -0,0 +1,309 @@
+package coordinator
+
+import (
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/go-redis/redis"
+	"go.uber.org/zap"
+)
+
+// The handover protocol moves a shard from one replica to another without a gap in events:
+//  1. the current owner offers the shard, and starts deduplicating its events
+//  2. a replica with capacity claims the offer, connects the shard, deduplicating its events, and signals readiness
+//  3. the current owner disconnects the shard, and transfers the lease to the new owner
+//  4. the new owner picks up the lease, and stops deduplicating
+// Offers which are not completed within the handover timeout are withdrawn.
+
+// handover progresses handovers this replica takes part in, and claims offers if this replica has capacity
+func (c *Coordinator) handover() error {
+	c.progressOffers(false)
+	c.promoteTaking()
+
+	c.lock.Lock()
+	capacity := c.target - len(c.held) - len(c.taking)
+	c.lock.Unlock()
+
+	if capacity <= 0 {
+		return nil
+	}
+
+	return c.takeOffers(capacity)
+}
+
+// offer offers a shard held by this replica to other replicas
+func (c *Coordinator) offer(shard Shard) {
+	c.lock.Lock()
+	if _, offered := c.offered[shard]; offered {
+		c.lock.Unlock()
+		return
+	}
+	c.offered[shard] = time.Now().Add(c.handoverTimeout)
+	c.lock.Unlock()
+
+	c.shards.SetOverlap(shard.BotID, shard.ID, true)
+
+	err := c.redis.SAdd(offersKey, shardMember(shard)).Err()
+	if err != nil {
+		raven.CaptureError(err, nil)
+		c.logger.Error("failed to offer shard",
+			zap.Error(err),
+			zap.String("bot_id", shard.BotID),
+			zap.Int("shard_id", shard.ID),
+		)
+		return
+	}
+
+	c.logger.Info("offered shard for handover",
+		zap.String("bot_id", shard.BotID),
+		zap.Int("shard_id", shard.ID),
+	)
+}
+
+// withdraw removes an offer for a shard, if there is any
+func (c *Coordinator) withdraw(shard Shard) {
+	c.lock.Lock()
+	_, offered := c.offered[shard]
+	delete(c.offered, shard)
+	c.lock.Unlock()
+	if !offered {
+		return
+	}
+
+	err := c.redis.SRem(offersKey, shardMember(shard)).Err()
+	if err != nil {
+		c.logger.Error("failed to withdraw shard offer",
+			zap.Error(err),
+			zap.String("bot_id", shard.BotID),
+			zap.Int("shard_id", shard.ID),
+		)
+	}
+	c.redis.Del(claimKey(shard), readyKey(shard))
+
+	c.shards.SetOverlap(shard.BotID, shard.ID, false)
+}
+
+// progressOffers completes offers whose new owners are ready, and withdraws offers which timed out,
+// while stopping, timed out offers are kept, as all shards will be released anyway
+func (c *Coordinator) progressOffers(stopping bool) {
+	c.lock.Lock()
+	offered := make(map[Shard]time.Time, len(c.offered))
+	for shard, deadline := range c.offered {
+		offered[shard] = deadline
+	}
+	c.lock.Unlock()
+
+	for shard, deadline := range offered {
+		newOwner, err := c.redis.Get(readyKey(shard)).Result()
+		if err != nil && err != redis.Nil {
+			c.logger.Error("failed to check handover readiness",
+				zap.Error(err),
+				zap.String("bot_id", shard.BotID),
+				zap.Int("shard_id", shard.ID),
+			)
+			continue
+		}
+
+		if newOwner != "" && newOwner != c.replicaID {
+			c.complete(shard, newOwner)
+			continue
+		}
+
+		if !stopping && time.Now().After(deadline) {
+			c.logger.Warn("handover timed out, keeping shard",
+				zap.String("bot_id", shard.BotID),
+				zap.Int("shard_id", shard.ID),
+			)
+			c.withdraw(shard)
+		}
+	}
+}
+
+// complete disconnects an offered shard after the new owner is connected, and transfers the lease to it
+func (c *Coordinator) complete(shard Shard, newOwner string) {
+	c.lock.Lock()
+	delete(c.held, shard)
+	c.lock.Unlock()
+
+	c.dropShard(shard)
+
+	transferred, err := transferScript.Run(
+		c.redis,
+		[]string{leaseKey(shard.BotID, shard.ID)},
+		c.replicaID,
+		newOwner,
+		c.leaseTTL.Milliseconds(),
+	).Int()
+	if err != nil {
+		raven.CaptureError(err, nil)
+		c.logger.Error("failed to transfer lease",
+			zap.Error(err),
+			zap.String("bot_id", shard.BotID),
+			zap.Int("shard_id", shard.ID),
+		)
+	}
+
+	c.withdraw(shard)
+
+	c.logger.Info("handed over shard",
+		zap.String("bot_id", shard.BotID),
+		zap.Int("shard_id", shard.ID),
+		zap.String("new_owner", newOwner),
+		zap.Bool("lease_transferred", transferred == 1),
+	)
+}
+
+// takeOffers claims up to count shards offered by other replicas, and connects them
+func (c *Coordinator) takeOffers(count int) error {
+	members, err := c.redis.SMembers(offersKey).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		if count <= 0 {
+			break
+		}
+
+		shard, ok := parseShardMember(member)
+		if !ok {
+			continue
+		}
+
+		c.lock.Lock()
+		_, known := c.bots[shard.BotID]
+		_, taking := c.taking[shard]
+		skip := !known || taking || c.held[shard] || c.starting[shard]
+		c.lock.Unlock()
+		if skip {
+			continue
+		}
+
+		claimed, err := c.redis.SetNX(claimKey(shard), c.replicaID, c.handoverTimeout).Result()
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+		count--
+
+		c.logger.Info("claimed shard offer, connecting shard",
+			zap.String("bot_id", shard.BotID),
+			zap.Int("shard_id", shard.ID),
+		)
+
+		c.lock.Lock()
+		c.taking[shard] = time.Now().Add(c.handoverTimeout)
+		c.lock.Unlock()
+
+		c.shards.SetOverlap(shard.BotID, shard.ID, true)
+
+		go c.takeOver(shard)
+	}
+
+	return nil
+}
+
+// takeOver connects a claimed shard, and signals readiness to the current owner
+func (c *Coordinator) takeOver(shard Shard) {
+	err := c.shards.TakeOverShard(shard.BotID, shard.ID)
+	if err != nil {
+		raven.CaptureError(err, nil)
+		c.logger.Error("failed to connect shard for handover",
+			zap.Error(err),
+			zap.String("bot_id", shard.BotID),
+			zap.Int("shard_id", shard.ID),
+		)
+
+		c.lock.Lock()
+		delete(c.taking, shard)
+		c.lock.Unlock()
+
+		c.redis.Del(claimKey(shard))
+		c.shards.SetOverlap(shard.BotID, shard.ID, false)
+		return
+	}
+
+	// the handover might have timed out, or the previous owner died, while connecting
+	c.lock.Lock()
+	_, taking := c.taking[shard]
+	held := c.held[shard]
+	c.lock.Unlock()
+	if held {
+		return
+	}
+	if !taking {
+		c.dropShard(shard)
+		return
+	}
+
+	err = c.redis.Set(readyKey(shard), c.replicaID, c.handoverTimeout).Err()
+	if err != nil {
+		raven.CaptureError(err, nil)
+		c.logger.Error("failed to signal handover readiness",
+			zap.Error(err),
+			zap.String("bot_id", shard.BotID),
+			zap.Int("shard_id", shard.ID),
+		)
+	}
+}
+
+// promoteTaking picks up leases transferred to this replica,
+// or acquires them if the previous owner died during the handover
+func (c *Coordinator) promoteTaking() {
+	c.lock.Lock()
+	taking := make(map[Shard]time.Time, len(c.taking))
+	for shard, deadline := range c.taking {
+		taking[shard] = deadline
+	}
+	c.lock.Unlock()
+
+	for shard, deadline := range taking {
+		owner, err := c.redis.Get(leaseKey(shard.BotID, shard.ID)).Result()
+		if err != nil && err != redis.Nil {
+			c.logger.Error("failed to check lease",
+				zap.Error(err),
+				zap.String("bot_id", shard.BotID),
+				zap.Int("shard_id", shard.ID),
+			)
+			continue
+		}
+
+		if owner == "" {
+			set, err := c.redis.SetNX(leaseKey(shard.BotID, shard.ID), c.replicaID, c.leaseTTL).Result()
+			if err == nil && set {
+				owner = c.replicaID
+			}
+		}
+
+		if owner == c.replicaID {
+			c.lock.Lock()
+			delete(c.taking, shard)
+			c.held[shard] = true
+			c.lock.Unlock()
+
+			c.shards.SetOverlap(shard.BotID, shard.ID, false)
+
+			c.logger.Info("took over shard",
+				zap.String("bot_id", shard.BotID),
+				zap.Int("shard_id", shard.ID),
+			)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			c.logger.Warn("handover timed out, disconnecting shard",
+				zap.String("bot_id", shard.BotID),
+				zap.Int("shard_id", shard.ID),
+			)
+
+			c.lock.Lock()
+			delete(c.taking, shard)
+			c.lock.Unlock()
+
+			c.dropShard(shard)
+			c.shards.SetOverlap(shard.BotID, shard.ID, false)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package coordinator
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	replicasKey = "cacophony.gateway.replicas"
+	offersKey   = "cacophony.gateway.handover.offers"
+)
+
+func leaseKey(botID string, shardID int) string {
+	return "cacophony.gateway.shards.lease." + shardMember(Shard{BotID: botID, ID: shardID})
+}
+
+func identifyKey(botID string, bucket int) string {
+	return "cacophony.gateway.identify." + botID + "." + strconv.Itoa(bucket)
+}
+
+func claimKey(shard Shard) string {
+	return "cacophony.gateway.handover.claim." + shardMember(shard)
+}
+
+func readyKey(shard Shard) string {
+	return "cacophony.gateway.handover.ready." + shardMember(shard)
+}
+
+func shardMember(shard Shard) string {
+	return shard.BotID + "." + strconv.Itoa(shard.ID)
+}
+
+func parseShardMember(member string) (Shard, bool) {
+	i := strings.LastIndex(member, ".")
+	if i < 0 {
+		return Shard{}, false
+	}
+
+	shardID, err := strconv.Atoi(member[i+1:])
+	if err != nil {
+		return Shard{}, false
+	}
+
+	return Shard{BotID: member[:i], ID: shardID}, true
+}
+
+// renewScript extends a lease, if it is still held by the given replica
+var renewScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseScript deletes a lease, if it is still held by the given replica
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// transferScript passes a lease on to another replica, if it is still held by the given replica
+var transferScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+	return 1
+end
+return 0
+`)
@@ -0,0 +1,152 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis"
+	"gitlab.com/Cacophony/Gateway/pkg/dispatch"
+)
+
+const (
+	// idsKey is a list of letter IDs, newest first
+	idsKey = "cacophony.gateway.dead-letters.ids"
+	// lettersKey is a hash of letters by ID
+	lettersKey = "cacophony.gateway.dead-letters.letters"
+)
+
+// pushScript adds a letter, and removes the oldest letters beyond the maximum length
+var pushScript = redis.NewScript(`
+redis.call("HSET", KEYS[2], ARGV[1], ARGV[2])
+redis.call("LPUSH", KEYS[1], ARGV[1])
+local evicted = redis.call("LRANGE", KEYS[1], ARGV[3], -1)
+if #evicted > 0 then
+	redis.call("HDEL", KEYS[2], unpack(evicted))
+	redis.call("LTRIM", KEYS[1], 0, ARGV[3] - 1)
+end
+return #evicted
+`)
+
+// ErrNotFound is returned if there is no letter with the given ID
+var ErrNotFound = errors.New("dead letter not found")
+
+// Letter is a gateway dispatch which could not be converted into an event
+type Letter struct {
+	ID         string          `json:"id"`
+	BotID      string          `json:"bot_id"`
+	ShardID    int             `json:"shard_id"`
+	ShardCount int             `json:"shard_count"`
+	SessionID  string          `json:"session_id"`
+	Type       string          `json:"type"`
+	Sequence   int64           `json:"sequence"`
+	Error      string          `json:"error"`
+	ReceivedAt time.Time       `json:"received_at"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// Decode decodes the payload of a letter into the discordgo event of its dispatch type
+func (l *Letter) Decode() (interface{}, error) {
+	return dispatch.Decode(l.Type, l.Payload)
+}
+
+// Queue stores letters in Redis, indexed by ID, it keeps up to maxLen letters, dropping the oldest ones
+type Queue struct {
+	redis  *redis.Client
+	maxLen int64
+}
+
+// NewQueue creates a new Queue
+func NewQueue(redisClient *redis.Client, maxLen int64) *Queue {
+	return &Queue{
+		redis:  redisClient,
+		maxLen: maxLen,
+	}
+}
+
+// Push adds a letter to the queue
+func (q *Queue) Push(letter *Letter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+
+	return pushScript.Run(
+		q.redis,
+		[]string{idsKey, lettersKey},
+		letter.ID,
+		data,
+		q.maxLen,
+	).Err()
+}
+
+// List returns up to limit letters, newest first
+func (q *Queue) List(limit int64) ([]*Letter, error) {
+	ids, err := q.redis.LRange(idsKey, 0, limit-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return []*Letter{}, nil
+	}
+
+	items, err := q.redis.HMGet(lettersKey, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]*Letter, 0, len(items))
+	for _, item := range items {
+		// letters removed in between
+		data, ok := item.(string)
+		if !ok {
+			continue
+		}
+
+		var letter Letter
+		err = json.Unmarshal([]byte(data), &letter)
+		if err != nil {
+			return nil, err
+		}
+
+		letters = append(letters, &letter)
+	}
+
+	return letters, nil
+}
+
+// Get returns the letter with the given ID
+func (q *Queue) Get(id string) (*Letter, error) {
+	data, err := q.redis.HGet(lettersKey, id).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var letter Letter
+	err = json.Unmarshal(data, &letter)
+	if err != nil {
+		return nil, err
+	}
+
+	return &letter, nil
+}
+
+// Remove removes the letter with the given ID from the queue
+func (q *Queue) Remove(id string) error {
+	pipe := q.redis.TxPipeline()
+	removed := pipe.HDel(lettersKey, id)
+	pipe.LRem(idsKey, 1, id)
+	_, err := pipe.Exec()
+	if err != nil {
+		return err
+	}
+
+	if removed.Val() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
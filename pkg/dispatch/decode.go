@@ -0,0 +1,83 @@
+package dispatch
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// types creates the discordgo event for each dispatch type, matching the events discordgo decodes dispatches into,
+// dispatch types added by a discordgo upgrade have to be added here as well
+var types = map[string]func() interface{}{
+	"CHANNEL_CREATE":                    func() interface{} { return &discordgo.ChannelCreate{} },
+	"CHANNEL_DELETE":                    func() interface{} { return &discordgo.ChannelDelete{} },
+	"CHANNEL_PINS_UPDATE":               func() interface{} { return &discordgo.ChannelPinsUpdate{} },
+	"CHANNEL_UPDATE":                    func() interface{} { return &discordgo.ChannelUpdate{} },
+	"GUILD_BAN_ADD":                     func() interface{} { return &discordgo.GuildBanAdd{} },
+	"GUILD_BAN_REMOVE":                  func() interface{} { return &discordgo.GuildBanRemove{} },
+	"GUILD_CREATE":                      func() interface{} { return &discordgo.GuildCreate{} },
+	"GUILD_DELETE":                      func() interface{} { return &discordgo.GuildDelete{} },
+	"GUILD_EMOJIS_UPDATE":               func() interface{} { return &discordgo.GuildEmojisUpdate{} },
+	"GUILD_INTEGRATIONS_UPDATE":         func() interface{} { return &discordgo.GuildIntegrationsUpdate{} },
+	"GUILD_MEMBER_ADD":                  func() interface{} { return &discordgo.GuildMemberAdd{} },
+	"GUILD_MEMBER_REMOVE":               func() interface{} { return &discordgo.GuildMemberRemove{} },
+	"GUILD_MEMBER_UPDATE":               func() interface{} { return &discordgo.GuildMemberUpdate{} },
+	"GUILD_MEMBERS_CHUNK":               func() interface{} { return &discordgo.GuildMembersChunk{} },
+	"GUILD_ROLE_CREATE":                 func() interface{} { return &discordgo.GuildRoleCreate{} },
+	"GUILD_ROLE_DELETE":                 func() interface{} { return &discordgo.GuildRoleDelete{} },
+	"GUILD_ROLE_UPDATE":                 func() interface{} { return &discordgo.GuildRoleUpdate{} },
+	"GUILD_SCHEDULED_EVENT_CREATE":      func() interface{} { return &discordgo.GuildScheduledEventCreate{} },
+	"GUILD_SCHEDULED_EVENT_DELETE":      func() interface{} { return &discordgo.GuildScheduledEventDelete{} },
+	"GUILD_SCHEDULED_EVENT_UPDATE":      func() interface{} { return &discordgo.GuildScheduledEventUpdate{} },
+	"GUILD_SCHEDULED_EVENT_USER_ADD":    func() interface{} { return &discordgo.GuildScheduledEventUserAdd{} },
+	"GUILD_SCHEDULED_EVENT_USER_REMOVE": func() interface{} { return &discordgo.GuildScheduledEventUserRemove{} },
+	"GUILD_UPDATE":                      func() interface{} { return &discordgo.GuildUpdate{} },
+	"INTERACTION_CREATE":                func() interface{} { return &discordgo.InteractionCreate{} },
+	"INVITE_CREATE":                     func() interface{} { return &discordgo.InviteCreate{} },
+	"INVITE_DELETE":                     func() interface{} { return &discordgo.InviteDelete{} },
+	"MESSAGE_ACK":                       func() interface{} { return &discordgo.MessageAck{} },
+	"MESSAGE_CREATE":                    func() interface{} { return &discordgo.MessageCreate{} },
+	"MESSAGE_DELETE":                    func() interface{} { return &discordgo.MessageDelete{} },
+	"MESSAGE_DELETE_BULK":               func() interface{} { return &discordgo.MessageDeleteBulk{} },
+	"MESSAGE_REACTION_ADD":              func() interface{} { return &discordgo.MessageReactionAdd{} },
+	"MESSAGE_REACTION_REMOVE":           func() interface{} { return &discordgo.MessageReactionRemove{} },
+	"MESSAGE_REACTION_REMOVE_ALL":       func() interface{} { return &discordgo.MessageReactionRemoveAll{} },
+	"MESSAGE_UPDATE":                    func() interface{} { return &discordgo.MessageUpdate{} },
+	"PRESENCE_UPDATE":                   func() interface{} { return &discordgo.PresenceUpdate{} },
+	"PRESENCES_REPLACE":                 func() interface{} { return &discordgo.PresencesReplace{} },
+	"READY":                             func() interface{} { return &discordgo.Ready{} },
+	"RELATIONSHIP_ADD":                  func() interface{} { return &discordgo.RelationshipAdd{} },
+	"RELATIONSHIP_REMOVE":               func() interface{} { return &discordgo.RelationshipRemove{} },
+	"RESUMED":                           func() interface{} { return &discordgo.Resumed{} },
+	"THREAD_CREATE":                     func() interface{} { return &discordgo.ThreadCreate{} },
+	"THREAD_DELETE":                     func() interface{} { return &discordgo.ThreadDelete{} },
+	"THREAD_LIST_SYNC":                  func() interface{} { return &discordgo.ThreadListSync{} },
+	"THREAD_MEMBER_UPDATE":              func() interface{} { return &discordgo.ThreadMemberUpdate{} },
+	"THREAD_MEMBERS_UPDATE":             func() interface{} { return &discordgo.ThreadMembersUpdate{} },
+	"THREAD_UPDATE":                     func() interface{} { return &discordgo.ThreadUpdate{} },
+	"TYPING_START":                      func() interface{} { return &discordgo.TypingStart{} },
+	"USER_GUILD_SETTINGS_UPDATE":        func() interface{} { return &discordgo.UserGuildSettingsUpdate{} },
+	"USER_NOTE_UPDATE":                  func() interface{} { return &discordgo.UserNoteUpdate{} },
+	"USER_SETTINGS_UPDATE":              func() interface{} { return &discordgo.UserSettingsUpdate{} },
+	"USER_UPDATE":                       func() interface{} { return &discordgo.UserUpdate{} },
+	"VOICE_SERVER_UPDATE":               func() interface{} { return &discordgo.VoiceServerUpdate{} },
+	"VOICE_STATE_UPDATE":                func() interface{} { return &discordgo.VoiceStateUpdate{} },
+	"WEBHOOKS_UPDATE":                   func() interface{} { return &discordgo.WebhooksUpdate{} },
+}
+
+// Decode decodes the payload of a dispatch into the discordgo event for its type
+func Decode(name string, payload []byte) (interface{}, error) {
+	newEvent, ok := types[name]
+	if !ok {
+		return nil, errors.New("dispatch type " + name + " is unknown to discordgo")
+	}
+
+	item := newEvent()
+	err := json.Unmarshal(payload, item)
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
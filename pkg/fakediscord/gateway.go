@@ -0,0 +1,424 @@
+package fakediscord
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/websocket"
+)
+
+// gateway opcodes, see https://discord.com/developers/docs/topics/opcodes-and-status-codes#gateway-gateway-opcodes
+const (
+	opDispatch            = 0
+	opHeartbeat           = 1
+	opIdentify            = 2
+	opPresenceUpdate      = 3
+	opResume              = 6
+	opRequestGuildMembers = 8
+	opInvalidSession      = 9
+	opHello               = 10
+	opHeartbeatAck        = 11
+)
+
+const (
+	// heartbeatInterval is the interval clients are asked to send heartbeats at, in milliseconds
+	heartbeatInterval = 41250
+
+	// bufferSize is the number of dispatches kept to be replayed on RESUME
+	bufferSize = 1000
+
+	closeAuthenticationFailed = 4004
+	closeInvalidSequence      = 4007
+	closeSessionTimedOut      = 4009
+	websocketGoingAway        = websocket.CloseGoingAway
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// frame is a gateway payload sent to clients
+type frame struct {
+	Operation int         `json:"op"`
+	Sequence  int64       `json:"s,omitempty"`
+	Type      string      `json:"t,omitempty"`
+	Data      interface{} `json:"d"`
+}
+
+// incoming is a gateway payload received from clients
+type incoming struct {
+	Operation int             `json:"op"`
+	Data      json.RawMessage `json:"d"`
+}
+
+// session is a gateway session of a single shard, it outlives its connection, so it can be resumed
+type session struct {
+	id         string
+	bot        *bot
+	shardID    int
+	shardCount int
+
+	lock     sync.Mutex
+	conn     *websocket.Conn
+	sequence int64
+	buffer   []*frame
+	presence *discordgo.UpdateStatusData
+}
+
+func (sess *session) connected() bool {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+
+	return sess.conn != nil
+}
+
+// attach makes the connection the current connection of the session
+func (sess *session) attach(conn *websocket.Conn) {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+
+	sess.conn = conn
+}
+
+// detach forgets the connection, if it is still the current connection of the session
+func (sess *session) detach(conn *websocket.Conn) {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+
+	if sess.conn == conn {
+		sess.conn = nil
+	}
+}
+
+func (sess *session) send(f *frame) error {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+
+	if sess.conn == nil {
+		return ErrNotConnected
+	}
+
+	return sess.conn.WriteJSON(f)
+}
+
+// dispatch sends an event with the next sequence number, and keeps it for resuming
+func (sess *session) dispatch(eventType string, data interface{}) error {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+
+	sess.sequence++
+	f := &frame{
+		Operation: opDispatch,
+		Sequence:  sess.sequence,
+		Type:      eventType,
+		Data:      data,
+	}
+
+	sess.buffer = append(sess.buffer, f)
+	if len(sess.buffer) > bufferSize {
+		sess.buffer = sess.buffer[len(sess.buffer)-bufferSize:]
+	}
+
+	if sess.conn == nil {
+		return ErrNotConnected
+	}
+
+	return sess.conn.WriteJSON(f)
+}
+
+// replay sends the dispatches after the given sequence number again, it returns false if some of them are gone
+func (sess *session) replay(sequence int64) (bool, error) {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+
+	if sequence > sess.sequence {
+		return false, nil
+	}
+	if len(sess.buffer) > 0 && sess.buffer[0].Sequence > sequence+1 {
+		return false, nil
+	}
+
+	for _, f := range sess.buffer {
+		if f.Sequence <= sequence {
+			continue
+		}
+
+		err := sess.conn.WriteJSON(f)
+		if err != nil {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
+// close closes the current connection with the given close code
+func (sess *session) close(code int) {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+
+	if sess.conn == nil {
+		return
+	}
+
+	sess.conn.WriteMessage( // nolint: errcheck
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, ""),
+	)
+	sess.conn.Close()
+	sess.conn = nil
+}
+
+// serveGateway handles a single gateway connection
+func (s *Server) serveGateway(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	err = conn.WriteJSON(&frame{
+		Operation: opHello,
+		Data: map[string]int{
+			"heartbeat_interval": heartbeatInterval,
+		},
+	})
+	if err != nil {
+		return
+	}
+
+	var sess *session
+	defer func() {
+		if sess != nil {
+			sess.detach(conn)
+		}
+	}()
+
+	for {
+		var payload incoming
+		err = conn.ReadJSON(&payload)
+		if err != nil {
+			return
+		}
+
+		switch payload.Operation {
+		case opHeartbeat:
+			err = s.write(conn, sess, &frame{Operation: opHeartbeatAck})
+		case opIdentify:
+			sess, err = s.identify(conn, payload.Data)
+		case opResume:
+			sess, err = s.resume(conn, payload.Data)
+		case opPresenceUpdate:
+			if sess != nil {
+				var presence discordgo.UpdateStatusData
+				if json.Unmarshal(payload.Data, &presence) == nil {
+					sess.lock.Lock()
+					sess.presence = &presence
+					sess.lock.Unlock()
+				}
+			}
+		case opRequestGuildMembers:
+			if sess != nil {
+				err = s.requestGuildMembers(sess, payload.Data)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// write sends a frame on the connection, through the session if there is one, as it might write concurrently
+func (s *Server) write(conn *websocket.Conn, sess *session, f *frame) error {
+	if sess != nil {
+		return sess.send(f)
+	}
+
+	return conn.WriteJSON(f)
+}
+
+func (s *Server) identify(conn *websocket.Conn, data json.RawMessage) (*session, error) {
+	var identify struct {
+		Token string  `json:"token"`
+		Shard *[2]int `json:"shard"`
+	}
+	err := json.Unmarshal(data, &identify)
+	if err != nil {
+		return nil, err
+	}
+
+	b := s.botForToken(identify.Token)
+	if b == nil {
+		closeConnection(conn, closeAuthenticationFailed)
+		return nil, ErrNotConnected
+	}
+
+	sess := &session{
+		id:         randomID(),
+		bot:        b,
+		shardCount: 1,
+		conn:       conn,
+	}
+	if identify.Shard != nil && identify.Shard[1] > 0 {
+		sess.shardID = identify.Shard[0]
+		sess.shardCount = identify.Shard[1]
+	}
+
+	s.lock.Lock()
+	s.sessions[sess.id] = sess
+	b.identified[sess.shardID]++
+	var guilds []*discordgo.Guild
+	for _, guildID := range b.guilds {
+		if guild, ok := s.guilds[guildID]; ok && shardForGuild(guildID, sess.shardCount) == sess.shardID {
+			guilds = append(guilds, guild)
+		}
+	}
+	s.lock.Unlock()
+
+	unavailable := make([]map[string]interface{}, 0, len(guilds))
+	for _, guild := range guilds {
+		unavailable = append(unavailable, map[string]interface{}{
+			"id":          guild.ID,
+			"unavailable": true,
+		})
+	}
+
+	err = sess.dispatch("READY", map[string]interface{}{
+		"v":                  json.Number(discordgo.APIVersion),
+		"user":               b.user,
+		"guilds":             unavailable,
+		"session_id":         sess.id,
+		"resume_gateway_url": s.GatewayURL(),
+		"shard":              [2]int{sess.shardID, sess.shardCount},
+		"private_channels":   []interface{}{},
+		"application": map[string]interface{}{
+			"id": b.user.ID,
+		},
+	})
+	if err != nil {
+		return sess, err
+	}
+
+	for _, guild := range guilds {
+		err = sess.dispatch("GUILD_CREATE", guild)
+		if err != nil {
+			return sess, err
+		}
+	}
+
+	return sess, nil
+}
+
+func (s *Server) resume(conn *websocket.Conn, data json.RawMessage) (*session, error) {
+	var resume struct {
+		Token     string `json:"token"`
+		SessionID string `json:"session_id"`
+		Sequence  int64  `json:"seq"`
+	}
+	err := json.Unmarshal(data, &resume)
+	if err != nil {
+		return nil, err
+	}
+
+	b := s.botForToken(resume.Token)
+	if b == nil {
+		closeConnection(conn, closeAuthenticationFailed)
+		return nil, ErrNotConnected
+	}
+
+	s.lock.Lock()
+	sess, ok := s.sessions[resume.SessionID]
+	s.lock.Unlock()
+	if !ok || sess.bot != b {
+		return nil, conn.WriteJSON(&frame{Operation: opInvalidSession, Data: false})
+	}
+
+	// a resumed session takes over from the previous connection
+	sess.close(websocket.CloseNormalClosure)
+	sess.attach(conn)
+
+	ok, err = sess.replay(resume.Sequence)
+	if err != nil {
+		return sess, err
+	}
+	if !ok {
+		s.lock.Lock()
+		delete(s.sessions, sess.id)
+		s.lock.Unlock()
+
+		return nil, conn.WriteJSON(&frame{Operation: opInvalidSession, Data: false})
+	}
+
+	s.lock.Lock()
+	b.resumed[sess.shardID]++
+	s.lock.Unlock()
+
+	return sess, sess.dispatch("RESUMED", map[string]interface{}{})
+}
+
+func (s *Server) requestGuildMembers(sess *session, data json.RawMessage) error {
+	var request struct {
+		GuildID json.RawMessage `json:"guild_id"`
+		Query   string          `json:"query"`
+		Limit   int             `json:"limit"`
+		Nonce   string          `json:"nonce"`
+	}
+	err := json.Unmarshal(data, &request)
+	if err != nil {
+		return err
+	}
+
+	// the guild ID may be a single ID, or a list of IDs
+	var guildIDs []string
+	var guildID string
+	if json.Unmarshal(request.GuildID, &guildID) == nil {
+		guildIDs = []string{guildID}
+	} else if err = json.Unmarshal(request.GuildID, &guildIDs); err != nil {
+		return err
+	}
+
+	for _, guildID := range guildIDs {
+		s.lock.Lock()
+		guild, ok := s.guilds[guildID]
+		var members []*discordgo.Member
+		if ok {
+			members = append(members, guild.Members...)
+		}
+		s.lock.Unlock()
+
+		if request.Limit > 0 && len(members) > request.Limit {
+			members = members[:request.Limit]
+		}
+
+		err = sess.dispatch("GUILD_MEMBERS_CHUNK", map[string]interface{}{
+			"guild_id":    guildID,
+			"members":     members,
+			"chunk_index": 0,
+			"chunk_count": 1,
+			"nonce":       request.Nonce,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func closeConnection(conn *websocket.Conn, code int) {
+	conn.WriteMessage( // nolint: errcheck
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, ""),
+	)
+}
+
+func randomID() string {
+	id := make([]byte, 16)
+	rand.Read(id) // nolint: errcheck
+
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,208 @@
+package fakediscord
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-chi/chi"
+)
+
+type botContextKey struct{}
+
+// restRoutes serves the parts of the REST API used by the gateway and the state
+func (s *Server) restRoutes(r chi.Router) {
+	r.Get("/gateway", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"url": s.GatewayURL(),
+		})
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(s.authenticate)
+
+		r.Get("/gateway/bot", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"url":    s.GatewayURL(),
+				"shards": botFromContext(r).shards,
+				"session_start_limit": map[string]int{
+					"total":           1000,
+					"remaining":       1000,
+					"reset_after":     0,
+					"max_concurrency": 1,
+				},
+			})
+		})
+
+		r.Get("/users/@me", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, botFromContext(r).user)
+		})
+
+		r.Route("/guilds/{guildID}", func(r chi.Router) {
+			r.Use(s.requireGuild)
+
+			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				s.withGuild(w, r, func(guild *discordgo.Guild) interface{} {
+					return guild
+				})
+			})
+			r.Get("/members", func(w http.ResponseWriter, r *http.Request) {
+				limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+				after := r.URL.Query().Get("after")
+
+				s.withGuild(w, r, func(guild *discordgo.Guild) interface{} {
+					members := make([]*discordgo.Member, 0, len(guild.Members))
+					for _, member := range guild.Members {
+						if after != "" && member.User != nil && !snowflakeAfter(member.User.ID, after) {
+							continue
+						}
+						members = append(members, member)
+					}
+					if limit > 0 && len(members) > limit {
+						members = members[:limit]
+					}
+					return members
+				})
+			})
+			r.Get("/members/{userID}", func(w http.ResponseWriter, r *http.Request) {
+				userID := chi.URLParam(r, "userID")
+
+				s.withGuild(w, r, func(guild *discordgo.Guild) interface{} {
+					for _, member := range guild.Members {
+						if member.User != nil && member.User.ID == userID {
+							return member
+						}
+					}
+					return nil
+				})
+			})
+			r.Get("/channels", func(w http.ResponseWriter, r *http.Request) {
+				s.withGuild(w, r, func(guild *discordgo.Guild) interface{} {
+					return append([]*discordgo.Channel{}, guild.Channels...)
+				})
+			})
+			r.Get("/roles", func(w http.ResponseWriter, r *http.Request) {
+				s.withGuild(w, r, func(guild *discordgo.Guild) interface{} {
+					return append([]*discordgo.Role{}, guild.Roles...)
+				})
+			})
+			r.Get("/webhooks", func(w http.ResponseWriter, _ *http.Request) {
+				writeJSON(w, http.StatusOK, []interface{}{})
+			})
+			r.Get("/invites", func(w http.ResponseWriter, _ *http.Request) {
+				writeJSON(w, http.StatusOK, []interface{}{})
+			})
+		})
+
+		r.Get("/channels/{channelID}", func(w http.ResponseWriter, r *http.Request) {
+			channelID := chi.URLParam(r, "channelID")
+
+			s.lock.Lock()
+			defer s.lock.Unlock()
+
+			for _, guildID := range botFromContext(r).guilds {
+				for _, channel := range s.guilds[guildID].Channels {
+					if channel.ID == channelID {
+						writeJSON(w, http.StatusOK, channel)
+						return
+					}
+				}
+			}
+
+			writeError(w, http.StatusNotFound, "Unknown Channel")
+		})
+	})
+
+	r.NotFound(func(w http.ResponseWriter, _ *http.Request) {
+		writeError(w, http.StatusNotFound, "404: Not Found")
+	})
+}
+
+// authenticate rejects requests without the token of a known bot, and records the requests of known bots
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := s.botForToken(r.Header.Get("Authorization"))
+		if b == nil {
+			writeError(w, http.StatusUnauthorized, "401: Unauthorized")
+			return
+		}
+
+		s.lock.Lock()
+		s.requests = append(s.requests, Request{
+			Method: r.Method,
+			Path:   r.URL.Path,
+			BotID:  b.user.ID,
+		})
+		s.lock.Unlock()
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), botContextKey{}, b)))
+	})
+}
+
+// requireGuild rejects requests for guilds the bot is not a member of
+func (s *Server) requireGuild(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		guildID := chi.URLParam(r, "guildID")
+
+		s.lock.Lock()
+		var member bool
+		for _, id := range botFromContext(r).guilds {
+			if id == guildID {
+				member = true
+			}
+		}
+		s.lock.Unlock()
+
+		if !member {
+			writeError(w, http.StatusNotFound, "Unknown Guild")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withGuild responds with the value returned for the requested guild, or not found for nil
+func (s *Server) withGuild(w http.ResponseWriter, r *http.Request, fn func(guild *discordgo.Guild) interface{}) {
+	s.lock.Lock()
+	value := fn(s.guilds[chi.URLParam(r, "guildID")])
+	s.lock.Unlock()
+
+	if value == nil {
+		writeError(w, http.StatusNotFound, "Unknown Member")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, value)
+}
+
+func botFromContext(r *http.Request) *bot {
+	b, _ := r.Context().Value(botContextKey{}).(*bot)
+
+	return b
+}
+
+// snowflakeAfter reports whether the snowflake a is greater than b
+func snowflakeAfter(a, b string) bool {
+	x, _ := strconv.ParseUint(a, 10, 64)
+	y, _ := strconv.ParseUint(b, 10, 64)
+
+	return x > y
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(value) // nolint: errcheck
+}
+
+// writeError responds with an error in the format of the Discord API
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"message": message,
+		"code":    0,
+	})
+}
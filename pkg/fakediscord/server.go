@@ -0,0 +1,277 @@
+package fakediscord
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-chi/chi"
+)
+
+// ErrNotConnected is returned if a shard has no open gateway connection
+var ErrNotConnected = errors.New("shard is not connected")
+
+// Server is a fake Discord, serving a subset of the REST API, and the gateway, on a local port.
+// Its URL can be used as DISCORD_API_BASE, the gateway is announced by the gateway endpoints like Discord does.
+// It is meant for end-to-end tests of the gateway.
+type Server struct {
+	// URL is the base URL of the server, including a trailing slash
+	URL string
+
+	listener net.Listener
+	http     *http.Server
+
+	lock     sync.Mutex
+	bots     map[string]*bot
+	guilds   map[string]*discordgo.Guild
+	sessions map[string]*session
+	requests []Request
+}
+
+// Request is a REST request received by the server
+type Request struct {
+	Method string
+	Path   string
+	BotID  string
+}
+
+type bot struct {
+	token      string
+	user       *discordgo.User
+	shards     int
+	guilds     []string
+	identified map[int]int
+	resumed    map[int]int
+}
+
+// New starts a server on a random local port
+func New() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		URL:      "http://" + listener.Addr().String() + "/",
+		listener: listener,
+		bots:     make(map[string]*bot),
+		guilds:   make(map[string]*discordgo.Guild),
+		sessions: make(map[string]*session),
+	}
+
+	router := chi.NewRouter()
+	// discordgo appends a slash to the gateway URL
+	router.Get("/gateway", s.serveGateway)
+	router.Get("/gateway/", s.serveGateway)
+	router.Route("/api/v"+discordgo.APIVersion, s.restRoutes)
+	s.http = &http.Server{Handler: router}
+
+	go s.http.Serve(listener) // nolint: errcheck
+
+	return s, nil
+}
+
+// Close stops the server, and closes all gateway connections
+func (s *Server) Close() error {
+	s.lock.Lock()
+	for _, sess := range s.sessions {
+		sess.close(websocketGoingAway)
+	}
+	s.lock.Unlock()
+
+	return s.http.Close()
+}
+
+// GatewayURL returns the websocket URL of the gateway
+func (s *Server) GatewayURL() string {
+	return "ws://" + s.listener.Addr().String() + "/gateway"
+}
+
+// AddBot adds a bot which can authenticate with the given token, its gateway is split into the given number of shards
+func (s *Server) AddBot(token string, user *discordgo.User, shards int) {
+	if shards < 1 {
+		shards = 1
+	}
+	user.Bot = true
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.bots[user.ID] = &bot{
+		token:      token,
+		user:       user,
+		shards:     shards,
+		identified: make(map[int]int),
+		resumed:    make(map[int]int),
+	}
+}
+
+// AddGuild adds a guild the given bot is a member of, it is sent as GUILD_CREATE to the shard of the guild
+// after READY, and its members, channels, and roles are served by the REST API
+func (s *Server) AddGuild(botID string, guild *discordgo.Guild) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.guilds[guild.ID] = guild
+	if b, ok := s.bots[botID]; ok {
+		b.guilds = append(b.guilds, guild.ID)
+	}
+}
+
+// Identifies returns the number of times the given shard of a bot identified
+func (s *Server) Identifies(botID string, shardID int) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if b, ok := s.bots[botID]; ok {
+		return b.identified[shardID]
+	}
+	return 0
+}
+
+// Resumes returns the number of times the given shard of a bot resumed its session
+func (s *Server) Resumes(botID string, shardID int) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if b, ok := s.bots[botID]; ok {
+		return b.resumed[shardID]
+	}
+	return 0
+}
+
+// Requests returns the REST requests received so far, in order
+func (s *Server) Requests() []Request {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]Request(nil), s.requests...)
+}
+
+// Connected reports whether the given shard of a bot has an open gateway connection
+func (s *Server) Connected(botID string, shardID int) bool {
+	return s.connectedSession(botID, shardID) != nil
+}
+
+// Dispatch sends an event to the given shard of a bot, it fails if the shard is not connected
+func (s *Server) Dispatch(botID string, shardID int, eventType string, data interface{}) error {
+	sess := s.connectedSession(botID, shardID)
+	if sess == nil {
+		return ErrNotConnected
+	}
+
+	return sess.dispatch(eventType, data)
+}
+
+// DispatchGuild sends an event to the shard of a bot the guild belongs to
+func (s *Server) DispatchGuild(botID, guildID string, eventType string, data interface{}) error {
+	s.lock.Lock()
+	b, ok := s.bots[botID]
+	s.lock.Unlock()
+	if !ok {
+		return ErrNotConnected
+	}
+
+	return s.Dispatch(botID, shardForGuild(guildID, b.shards), eventType, data)
+}
+
+// Disconnect closes the gateway connection of the given shard of a bot with the close code,
+// the session can be resumed afterwards, unless the code does not allow it
+func (s *Server) Disconnect(botID string, shardID int, closeCode int) error {
+	sess := s.connectedSession(botID, shardID)
+	if sess == nil {
+		return ErrNotConnected
+	}
+
+	sess.close(closeCode)
+
+	if !resumable(closeCode) {
+		s.lock.Lock()
+		delete(s.sessions, sess.id)
+		s.lock.Unlock()
+	}
+
+	return nil
+}
+
+// InvalidateSession sends an Invalid Session to the given shard of a bot, it has to identify again
+func (s *Server) InvalidateSession(botID string, shardID int) error {
+	sess := s.connectedSession(botID, shardID)
+	if sess == nil {
+		return ErrNotConnected
+	}
+
+	s.lock.Lock()
+	delete(s.sessions, sess.id)
+	s.lock.Unlock()
+
+	return sess.send(&frame{Operation: opInvalidSession, Data: false})
+}
+
+// Presence returns the last presence sent by the given shard of a bot
+func (s *Server) Presence(botID string, shardID int) *discordgo.UpdateStatusData {
+	sess := s.connectedSession(botID, shardID)
+	if sess == nil {
+		return nil
+	}
+
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+
+	return sess.presence
+}
+
+// connectedSession returns the session of a shard with an open connection, if any
+func (s *Server) connectedSession(botID string, shardID int) *session {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, sess := range s.sessions {
+		if sess.bot.user.ID == botID && sess.shardID == shardID && sess.connected() {
+			return sess
+		}
+	}
+
+	return nil
+}
+
+// botForToken returns the bot authenticating with the given token, with or without the Bot prefix
+func (s *Server) botForToken(token string) *bot {
+	token = strings.TrimPrefix(token, "Bot ")
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, b := range s.bots {
+		if b.token == token {
+			return b
+		}
+	}
+
+	return nil
+}
+
+// resumable reports whether a session can be resumed after its connection has been closed with the close code
+func resumable(closeCode int) bool {
+	switch closeCode {
+	case closeAuthenticationFailed, closeInvalidSequence, closeSessionTimedOut:
+		return false
+	}
+
+	return closeCode < 4010
+}
+
+// shardForGuild returns the shard a guild belongs to,
+// see https://discord.com/developers/docs/topics/gateway#sharding-sharding-formula
+func shardForGuild(guildID string, shards int) int {
+	id, err := strconv.ParseUint(guildID, 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return int((id >> 22) % uint64(shards))
+}
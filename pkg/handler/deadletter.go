@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"context"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	raven "github.com/getsentry/raven-go"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"gitlab.com/Cacophony/Gateway/pkg/deadletter"
+	"gitlab.com/Cacophony/Gateway/pkg/metrics"
+	"gitlab.com/Cacophony/go-kit/events"
+	"go.uber.org/zap"
+)
+
+// ErrDropped is returned when resubmitting a dead letter whose event is filtered, or dropped by the routing table
+var ErrDropped = errors.New("event has been dropped by the rules or the routing table")
+
+// unexpectedEvent returns true for the error the events package returns for dispatches it does not model,
+// those are not conversion failures, see EnableRawPassthrough to publish them anyway
+func unexpectedEvent(err error) bool {
+	return err != nil && err.Error() == "received unexpected event"
+}
+
+// deadLetter stores a dispatch which could not be converted into an event, so it can be resubmitted later
+func (eh *EventHandler) deadLetter(session *discordgo.Session, raw *discordgo.Event, source origin, cause error) {
+	if eh.deadLetters == nil {
+		return
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		raven.CaptureError(err, nil)
+		eh.logger.Error("unable to generate dead letter ID", zap.Error(err))
+		return
+	}
+
+	letter := &deadletter.Letter{
+		ID:         id.String(),
+		BotID:      session.State.User.ID,
+		ShardID:    source.ShardID,
+		ShardCount: source.ShardCount,
+		SessionID:  source.SessionID,
+		Type:       raw.Type,
+		Sequence:   raw.Sequence,
+		Error:      cause.Error(),
+		ReceivedAt: time.Now().UTC(),
+		Payload:    raw.RawData,
+	}
+
+	err = eh.deadLetters.Push(letter)
+	if err != nil {
+		raven.CaptureError(err, nil)
+		eh.logger.Error("unable to store dead letter",
+			zap.Error(err),
+			zap.String("dispatch_type", raw.Type),
+		)
+		return
+	}
+
+	metrics.DeadLetters.WithLabelValues(raw.Type).Inc()
+}
+
+// Resubmit converts a dead letter into an event again, and publishes it, it returns once the event has been delivered,
+// or ErrDropped if it is not published.
+// The shared state is not updated, as it has handled the dispatch when it was received, and no diff events are
+// generated for the same reason.
+func (eh *EventHandler) Resubmit(letter *deadletter.Letter) error {
+	eventItem, err := letter.Decode()
+	if err != nil {
+		return errors.Wrap(err, "unable to decode dead letter")
+	}
+
+	event, _, err := events.GenerateEventFromDiscordgoEvent(letter.BotID, eventItem)
+	if err != nil {
+		return errors.Wrap(err, "unable to generate event")
+	}
+	if event == nil {
+		return errors.New("dispatch type " + letter.Type + " is not published")
+	}
+	event.ReceivedAt = letter.ReceivedAt
+
+	if event.GuildID != "" && (eh.checker.IsBlacklisted(event.GuildID) || !eh.checker.IsWhitelisted(event.GuildID)) {
+		return errors.New("guild is not allowed to receive events")
+	}
+
+	session := &discordgo.Session{
+		State:      discordgo.NewState(),
+		ShardID:    letter.ShardID,
+		ShardCount: letter.ShardCount,
+	}
+	session.State.User = &discordgo.User{ID: letter.BotID}
+
+	return eh.deliverConfirmed(context.Background(), session, origin{
+		ShardID:    letter.ShardID,
+		ShardCount: letter.ShardCount,
+		SessionID:  letter.SessionID,
+		Sequence:   letter.Sequence,
+	}, event)
+}
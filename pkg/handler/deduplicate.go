@@ -2,19 +2,64 @@ package handler
 
 import (
 	"errors"
+	"strconv"
 	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-redis/redis"
 )
 
-func (eh *EventHandler) IsDuplicate(key string, expiration time.Duration) (bool, error) {
+// RedisDeduplicator deduplicates events across replicas using Redis keys
+type RedisDeduplicator struct {
+	redis *redis.Client
+}
+
+// NewRedisDeduplicator creates a new RedisDeduplicator
+func NewRedisDeduplicator(redisClient *redis.Client) *RedisDeduplicator {
+	return &RedisDeduplicator{
+		redis: redisClient,
+	}
+}
+
+// IsDuplicate reports whether the key has been set before, and sets it otherwise
+func (d *RedisDeduplicator) IsDuplicate(key string, expiration time.Duration) (bool, error) {
 	if key == "" {
 		return false, errors.New("passed key is empty")
 	}
 
 	// insert if not exists
-	set, err := eh.redisClient.SetNX(key, true, expiration).Result()
+	set, err := d.redis.SetNX(key, true, expiration).Result()
 	if err != nil {
 		return false, err
 	}
 
 	return !set, nil
 }
+
+// SetOverlap forces deduplication of the events of a shard, regardless of configuration,
+// while another connection might receive the same events, e.g. during a handover
+func (eh *EventHandler) SetOverlap(botID string, shardID int, overlap bool) {
+	key := botID + ":" + strconv.Itoa(shardID)
+
+	eh.overlapLock.Lock()
+	defer eh.overlapLock.Unlock()
+
+	if overlap {
+		eh.overlap[key] = true
+		return
+	}
+	delete(eh.overlap, key)
+}
+
+func (eh *EventHandler) shouldDeduplicate(session *discordgo.Session) bool {
+	if eh.deduplicate {
+		return true
+	}
+
+	key := session.State.User.ID + ":" + strconv.Itoa(session.ShardID)
+
+	eh.overlapLock.RLock()
+	defer eh.overlapLock.RUnlock()
+
+	return eh.overlap[key]
+}
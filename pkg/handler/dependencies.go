@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// State is the shared state events are applied to, and compared against for diff events,
+// it is implemented by state.State, see the handlertest package for an in-memory implementation
+type State interface {
+	SharedStateEventHandler(session *discordgo.Session, i interface{}) error
+	Guild(guildID string) (*discordgo.Guild, error)
+	Member(guildID, userID string) (*discordgo.Member, error)
+	Channel(channelID string) (*discordgo.Channel, error)
+	Role(guildID, roleID string) (*discordgo.Role, error)
+	GuildWebhooks(guildID string) ([]*discordgo.Webhook, error)
+	BotForGuild(guildID string, permissions ...int64) (string, error)
+}
+
+// Checker decides which guilds events are published for, it is implemented by whitelist.Checker
+type Checker interface {
+	IsWhitelisted(guildID string) bool
+	IsBlacklisted(guildID string) bool
+}
+
+// Deduplicator reports whether an event with the same key has been seen within the expiration,
+// by any replica, see RedisDeduplicator
+type Deduplicator interface {
+	IsDuplicate(key string, expiration time.Duration) (bool, error)
+}
+
+// SessionTracker knows the gateway session ID of a shard session, it is set by READY dispatches,
+// it is implemented by the resume tracker of the gateway
+type SessionTracker interface {
+	SessionID() string
+}
+
+// Filter decides whether an event is published, it is implemented by rules.Engine
+type Filter interface {
+	Allowed(eventType, guildID, channelID, botID string) bool
+}
@@ -2,14 +2,17 @@ package handler
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 	raven "github.com/getsentry/raven-go"
-	"github.com/go-redis/redis"
-	"gitlab.com/Cacophony/Gateway/pkg/whitelist"
+	"gitlab.com/Cacophony/Gateway/pkg/deadletter"
+	"gitlab.com/Cacophony/Gateway/pkg/metrics"
+	"gitlab.com/Cacophony/Gateway/pkg/outbox"
+	"gitlab.com/Cacophony/Gateway/pkg/recording"
+	"gitlab.com/Cacophony/Gateway/pkg/routing"
 	"gitlab.com/Cacophony/go-kit/events"
-	"gitlab.com/Cacophony/go-kit/state"
 	"go.opentelemetry.io/contrib/propagators/b3"
 	"go.opentelemetry.io/otel/api/global"
 	"go.uber.org/zap"
@@ -17,65 +20,160 @@ import (
 
 var b3Prop = b3.B3{}
 
-// EventHandler handles discord events and puts them into rabbitMQ
+// EventHandler handles discord events and publishes them
 type EventHandler struct {
 	logger                   *zap.Logger
-	redisClient              *redis.Client
-	publisher                *events.Publisher
-	checker                  *whitelist.Checker
-	state                    *state.State
+	deduplicator             Deduplicator
+	publisher                Publisher
+	checker                  Checker
+	filter                   Filter
+	state                    State
 	requestGuildMembersDelay time.Duration
 	deduplicate              bool
+
+	overlap     map[string]bool
+	overlapLock sync.RWMutex
+
+	publisherHealth publisherHealth
+	outbox          *outbox.Outbox
+	routes          *routing.Table
+	pipeline        *pipeline
+	workers         *workers
+	deadLetters     *deadletter.Queue
+	rawPassthrough  bool
+	recorder        *recording.Recorder
+
+	// redeliverLock makes sure only one redelivery reads the outbox at a time
+	redeliverLock sync.Mutex
 }
 
 // NewEventHandler creates a new EventHandler
 func NewEventHandler(
 	logger *zap.Logger,
-	redisClient *redis.Client,
-	publisher *events.Publisher,
-	checker *whitelist.Checker,
-	state *state.State,
+	deduplicator Deduplicator,
+	publisher Publisher,
+	checker Checker,
+	filter Filter,
+	state State,
 	deduplicate bool,
 	requestGuildMembersDelay time.Duration,
+	outbox *outbox.Outbox,
+	routes *routing.Table,
+	deadLetters *deadletter.Queue,
 ) *EventHandler {
 	return &EventHandler{
 		logger:                   logger,
-		redisClient:              redisClient,
+		deduplicator:             deduplicator,
 		publisher:                publisher,
 		checker:                  checker,
+		filter:                   filter,
 		state:                    state,
 		deduplicate:              deduplicate,
 		requestGuildMembersDelay: requestGuildMembersDelay,
+		overlap:                  make(map[string]bool),
+		outbox:                   outbox,
+		routes:                   routes,
+		deadLetters:              deadLetters,
 	}
 }
 
-// OnDiscordEvent receives discord events
+// OnDiscordEvent receives discord events of a session without a tracked session ID, see HandlerFor
 func (eh *EventHandler) OnDiscordEvent(session *discordgo.Session, eventItem interface{}) {
-	var err error
+	eh.onDiscordEvent(session, "", eventItem)
+}
 
+// HandlerFor returns the handler for discord events of a session, published events carry the session ID known to
+// the tracker, it must be added to the session after the tracker, so the tracker handles READY dispatches first
+func (eh *EventHandler) HandlerFor(tracker SessionTracker) func(*discordgo.Session, interface{}) {
+	return func(session *discordgo.Session, eventItem interface{}) {
+		eh.onDiscordEvent(session, tracker.SessionID(), eventItem)
+	}
+}
+
+// onDiscordEvent receives discord events, sessions must deliver them in order, see discordgo.Session.SyncEvents.
+// Events of the same guild, or the same channel for direct messages, are handled one after another, in the order
+// they have been received in, events of different guilds are handled concurrently, see StartWorkers.
+func (eh *EventHandler) onDiscordEvent(session *discordgo.Session, sessionID string, eventItem interface{}) {
 	if session == nil || session.State == nil || session.State.User == nil {
 		return
 	}
 
-	ready, ok := eventItem.(*discordgo.Ready)
-	if ok {
-		go eh.requestGuildMembers(session, ready)
+	eventItem, raw, ok := unwrapDispatch(eventItem)
+	if !ok {
+		return
 	}
+	if eh.recorder != nil && raw != nil {
+		err := eh.recorder.Record(session, raw)
+		if err != nil {
+			eh.logger.Error("unable to record event", zap.Error(err))
+		}
+	}
+	var sequence int64
+	if raw != nil {
+		sequence = raw.Sequence
+	}
+	source := newOrigin(session, sessionID, sequence)
 
 	event, expiration, err := events.GenerateEventFromDiscordgoEvent(
 		session.State.User.ID,
 		eventItem,
 	)
+
+	// dispatches unknown to discordgo, or not modelled by the events package, are passed as their raw event,
+	// dispatches which failed to convert are dead letters instead
+	if eh.rawPassthrough && raw != nil && (eventItem == raw || unexpectedEvent(err)) {
+		event, expiration, err = rawEvent(session.State.User.ID, raw)
+		source.Raw = &rawDispatch{
+			Name:    raw.Type,
+			Payload: raw.RawData,
+		}
+	}
+
+	key := session.State.User.ID
+	if raw != nil {
+		key = dispatchKey(key, raw)
+	}
+
+	eh.workers.dispatch(key, func() {
+		eh.handle(session, eventItem, raw, source, event, expiration, err)
+	})
+}
+
+// handle processes a single discord event, and publishes it
+func (eh *EventHandler) handle(
+	session *discordgo.Session,
+	eventItem interface{},
+	raw *discordgo.Event,
+	source origin,
+	event *events.Event,
+	expiration time.Duration,
+	err error,
+) {
+	ready, ok := eventItem.(*discordgo.Ready)
+	if ok {
+		go eh.requestGuildMembers(session, ready)
+	}
+
 	if err != nil {
-		raven.CaptureError(err, nil)
-		eh.logger.Error("unable to generate event",
-			zap.Error(err),
-			zap.Any("event", eventItem),
-		)
+		if unexpectedEvent(err) {
+			eh.logger.Debug("skipping event, as it is not modelled by the events package",
+				zap.Any("event", eventItem),
+			)
+		} else {
+			raven.CaptureError(err, nil)
+			eh.logger.Error("unable to generate event",
+				zap.Error(err),
+				zap.Any("event", eventItem),
+			)
+			if raw != nil {
+				eh.deadLetter(session, raw, source, err)
+			}
+		}
 
 		err = eh.state.SharedStateEventHandler(session, eventItem)
 		if err != nil {
 			raven.CaptureError(err, nil)
+			metrics.StateErrors.Inc()
 			eh.logger.Error("state client failed to handle event", zap.Error(err))
 		}
 		return
@@ -85,11 +183,14 @@ func (eh *EventHandler) OnDiscordEvent(session *discordgo.Session, eventItem int
 		err = eh.state.SharedStateEventHandler(session, eventItem)
 		if err != nil {
 			raven.CaptureError(err, nil)
+			metrics.StateErrors.Inc()
 			eh.logger.Error("state client failed to handle event", zap.Error(err))
 		}
 		return
 	}
 
+	metrics.EventsReceived.WithLabelValues(string(event.Type), event.BotUserID).Inc()
+
 	ctx, span := global.Tracer("cacophony.dev/gateway").Start(context.Background(), "Recv.Discord")
 	defer span.End()
 
@@ -104,6 +205,8 @@ func (eh *EventHandler) OnDiscordEvent(session *discordgo.Session, eventItem int
 	)
 
 	l := eh.logger.With(
+		zap.Int("shard_id", session.ShardID),
+		zap.Int64("sequence", source.Sequence),
 		zap.String("event_id", event.ID),
 		zap.String("event_type", string(event.Type)),
 		zap.String("event_guild_id", event.GuildID),
@@ -112,6 +215,7 @@ func (eh *EventHandler) OnDiscordEvent(session *discordgo.Session, eventItem int
 	)
 
 	if event.GuildID != "" && eh.checker.IsBlacklisted(event.GuildID) {
+		metrics.EventsDropped.WithLabelValues(metrics.DropBlacklisted, string(event.Type)).Inc()
 		return
 	}
 
@@ -146,8 +250,8 @@ func (eh *EventHandler) OnDiscordEvent(session *discordgo.Session, eventItem int
 		// oldInvites, _ = eh.state.GuildInvites(event.GuildID)
 	}
 
-	if eh.deduplicate {
-		duplicate, err := eh.IsDuplicate(event.CacheKey, expiration)
+	if eh.shouldDeduplicate(session) {
+		duplicate, err := eh.deduplicator.IsDuplicate(event.CacheKey, expiration)
 		if err != nil {
 			raven.CaptureError(err, nil)
 			l.Debug("unable to deduplicate event",
@@ -158,11 +262,13 @@ func (eh *EventHandler) OnDiscordEvent(session *discordgo.Session, eventItem int
 			err = eh.state.SharedStateEventHandler(session, eventItem)
 			if err != nil {
 				raven.CaptureError(err, nil)
+				metrics.StateErrors.Inc()
 				l.Error("state client failed to handle event", zap.Error(err))
 			}
 			return
 		}
 		if duplicate {
+			metrics.EventsDropped.WithLabelValues(metrics.DropDuplicate, string(event.Type)).Inc()
 			l.Debug("skipping event, as it is a duplicate", zap.String("cache_key", event.CacheKey))
 			return
 		}
@@ -171,10 +277,12 @@ func (eh *EventHandler) OnDiscordEvent(session *discordgo.Session, eventItem int
 	err = eh.state.SharedStateEventHandler(session, eventItem)
 	if err != nil {
 		raven.CaptureError(err, nil)
+		metrics.StateErrors.Inc()
 		l.Error("state client failed to handle event", zap.Error(err))
 	}
 
 	if event.GuildID != "" && !eh.checker.IsWhitelisted(event.GuildID) {
+		metrics.EventsDropped.WithLabelValues(metrics.DropNotWhitelisted, string(event.Type)).Inc()
 		l.Debug("skipping publishing event because guild is not whitelisted")
 		return
 	}
@@ -296,9 +404,14 @@ func (eh *EventHandler) OnDiscordEvent(session *discordgo.Session, eventItem int
 	if err != nil {
 		raven.CaptureError(err, nil)
 	}
+	if diffEvent != nil {
+		metrics.DiffEvents.WithLabelValues(string(diffEvent.Type)).Inc()
+	}
 
-	err, recoverable := eh.publisher.Publish(
+	err, recoverable := eh.publish(
 		ctx,
+		session,
+		source,
 		event,
 	)
 	if err != nil {
@@ -317,8 +430,10 @@ func (eh *EventHandler) OnDiscordEvent(session *discordgo.Session, eventItem int
 	l.Debug("published event")
 
 	if diffEvent != nil {
-		err, recoverable = eh.publisher.Publish(
+		err, recoverable = eh.publish(
 			context.TODO(),
+			session,
+			source,
 			diffEvent,
 		)
 		if err != nil {
@@ -0,0 +1,406 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"gitlab.com/Cacophony/Gateway/pkg/handler"
+	"gitlab.com/Cacophony/Gateway/pkg/handler/handlertest"
+	"gitlab.com/Cacophony/Gateway/pkg/publisher"
+	"gitlab.com/Cacophony/go-kit/events"
+	"go.uber.org/zap"
+)
+
+const (
+	botID     = "10"
+	guildID   = "100"
+	channelID = "200"
+	roleID    = "300"
+	userID    = "400"
+	emojiID   = "500"
+)
+
+// fixture is an event handler with in-memory dependencies, receiving events of a single bot
+type fixture struct {
+	handler   *handler.EventHandler
+	publisher *publisher.Memory
+	checker   *handlertest.Checker
+	state     *handlertest.State
+	session   *discordgo.Session
+	sequence  int64
+}
+
+func newFixture(t *testing.T, whitelist bool) *fixture {
+	t.Helper()
+
+	f := &fixture{
+		publisher: publisher.NewMemory(),
+		checker:   handlertest.NewChecker(whitelist),
+		state:     handlertest.NewState(),
+		session: &discordgo.Session{
+			State:      discordgo.NewState(),
+			ShardCount: 1,
+		},
+	}
+	f.session.State.User = &discordgo.User{ID: botID}
+	f.handler = handler.NewEventHandler(
+		zap.NewNop(),
+		handlertest.NewDeduplicator(),
+		f.publisher,
+		f.checker,
+		nil,
+		f.state,
+		true,
+		time.Hour,
+		nil,
+		nil,
+		nil,
+	)
+
+	return f
+}
+
+// dispatch passes an event to the handler, like a session of the gateway receiving it as a dispatch
+func (f *fixture) dispatch(t *testing.T, eventType string, item interface{}) {
+	t.Helper()
+
+	rawData, err := json.Marshal(item)
+	if err != nil {
+		t.Fatalf("unable to marshal %s: %v", eventType, err)
+	}
+
+	f.sequence++
+	f.handler.OnDiscordEvent(f.session, &discordgo.Event{
+		Operation: 0,
+		Sequence:  f.sequence,
+		Type:      eventType,
+		RawData:   rawData,
+		Struct:    item,
+	})
+}
+
+// published returns the events published since the last call
+func (f *fixture) published(t *testing.T) []*events.Event {
+	t.Helper()
+
+	published, err := f.publisher.Events()
+	if err != nil {
+		t.Fatalf("unable to decode published events: %v", err)
+	}
+	f.publisher.Reset()
+
+	return published
+}
+
+func testGuild() *discordgo.Guild {
+	return &discordgo.Guild{
+		ID:   guildID,
+		Name: "old",
+		Channels: []*discordgo.Channel{
+			{ID: channelID, GuildID: guildID, Name: "old", Type: discordgo.ChannelTypeGuildText},
+		},
+		Roles: []*discordgo.Role{
+			{ID: roleID, Name: "old"},
+		},
+		Emojis: []*discordgo.Emoji{
+			{ID: emojiID, Name: "old"},
+		},
+		Members: []*discordgo.Member{
+			{GuildID: guildID, Nick: "old", User: &discordgo.User{ID: userID}},
+		},
+	}
+}
+
+func TestEventHandler(t *testing.T) {
+	message := &discordgo.MessageCreate{Message: &discordgo.Message{
+		ID:        "600",
+		ChannelID: channelID,
+		GuildID:   guildID,
+		Content:   "hello",
+		Author:    &discordgo.User{ID: userID},
+	}}
+
+	tests := []struct {
+		name string
+		// whitelist enables the whitelist, the guild is whitelisted unless blacklisted or notWhitelisted is set
+		whitelist      bool
+		blacklisted    bool
+		notWhitelisted bool
+		setup          func(f *fixture)
+		dispatches     []func(t *testing.T, f *fixture)
+		want           []events.Type
+		check          func(t *testing.T, published []*events.Event)
+	}{
+		{
+			name: "message",
+			dispatches: []func(t *testing.T, f *fixture){
+				func(t *testing.T, f *fixture) { f.dispatch(t, "MESSAGE_CREATE", message) },
+			},
+			want: []events.Type{events.MessageCreateType},
+		},
+		{
+			name:        "blacklisted",
+			whitelist:   true,
+			blacklisted: true,
+			dispatches: []func(t *testing.T, f *fixture){
+				func(t *testing.T, f *fixture) { f.dispatch(t, "MESSAGE_CREATE", message) },
+			},
+		},
+		{
+			name:           "not whitelisted",
+			whitelist:      true,
+			notWhitelisted: true,
+			dispatches: []func(t *testing.T, f *fixture){
+				func(t *testing.T, f *fixture) {
+					f.dispatch(t, "GUILD_UPDATE", &discordgo.GuildUpdate{Guild: &discordgo.Guild{
+						ID:   guildID,
+						Name: "new",
+					}})
+				},
+			},
+		},
+		{
+			name: "duplicate",
+			dispatches: []func(t *testing.T, f *fixture){
+				func(t *testing.T, f *fixture) { f.dispatch(t, "MESSAGE_CREATE", message) },
+				func(t *testing.T, f *fixture) { f.dispatch(t, "MESSAGE_CREATE", message) },
+			},
+			want: []events.Type{events.MessageCreateType},
+		},
+		{
+			name: "guild update",
+			dispatches: []func(t *testing.T, f *fixture){
+				func(t *testing.T, f *fixture) {
+					f.dispatch(t, "GUILD_UPDATE", &discordgo.GuildUpdate{Guild: &discordgo.Guild{
+						ID:   guildID,
+						Name: "new",
+					}})
+				},
+			},
+			want: []events.Type{events.GuildUpdateType, events.CacophonyDiffGuild},
+			check: func(t *testing.T, published []*events.Event) {
+				diff := published[1].DiffGuild
+				if diff == nil || diff.Old == nil || diff.New == nil {
+					t.Fatalf("expected old and new guild, got %+v", diff)
+				}
+				if diff.Old.Name != "old" || diff.New.Name != "new" {
+					t.Errorf("expected guild name to change from old to new, got %q to %q", diff.Old.Name, diff.New.Name)
+				}
+			},
+		},
+		{
+			name: "member update",
+			dispatches: []func(t *testing.T, f *fixture){
+				func(t *testing.T, f *fixture) {
+					f.dispatch(t, "GUILD_MEMBER_UPDATE", &discordgo.GuildMemberUpdate{Member: &discordgo.Member{
+						GuildID: guildID,
+						Nick:    "new",
+						User:    &discordgo.User{ID: userID},
+					}})
+				},
+			},
+			want: []events.Type{events.GuildMemberUpdateType, events.CacophonyDiffMember},
+			check: func(t *testing.T, published []*events.Event) {
+				diff := published[1].DiffMember
+				if diff == nil || diff.Old == nil || diff.New == nil {
+					t.Fatalf("expected old and new member, got %+v", diff)
+				}
+				if diff.Old.Nick != "old" || diff.New.Nick != "new" {
+					t.Errorf("expected nick to change from old to new, got %q to %q", diff.Old.Nick, diff.New.Nick)
+				}
+			},
+		},
+		{
+			name: "channel update",
+			dispatches: []func(t *testing.T, f *fixture){
+				func(t *testing.T, f *fixture) {
+					f.dispatch(t, "CHANNEL_UPDATE", &discordgo.ChannelUpdate{Channel: &discordgo.Channel{
+						ID:      channelID,
+						GuildID: guildID,
+						Name:    "new",
+						Type:    discordgo.ChannelTypeGuildText,
+					}})
+				},
+			},
+			want: []events.Type{events.ChannelUpdateType, events.CacophonyDiffChannel},
+			check: func(t *testing.T, published []*events.Event) {
+				diff := published[1].DiffChannel
+				if diff == nil || diff.Old == nil || diff.New == nil {
+					t.Fatalf("expected old and new channel, got %+v", diff)
+				}
+				if diff.Old.Name != "old" || diff.New.Name != "new" {
+					t.Errorf("expected channel name to change from old to new, got %q to %q",
+						diff.Old.Name, diff.New.Name)
+				}
+			},
+		},
+		{
+			name: "channel delete",
+			dispatches: []func(t *testing.T, f *fixture){
+				func(t *testing.T, f *fixture) {
+					f.dispatch(t, "CHANNEL_DELETE", &discordgo.ChannelDelete{Channel: &discordgo.Channel{
+						ID:      channelID,
+						GuildID: guildID,
+						Type:    discordgo.ChannelTypeGuildText,
+					}})
+				},
+			},
+			want: []events.Type{events.ChannelDeleteType, events.CacophonyDiffChannel},
+			check: func(t *testing.T, published []*events.Event) {
+				diff := published[1].DiffChannel
+				if diff == nil || diff.Old == nil || diff.New != nil {
+					t.Fatalf("expected only the old channel, got %+v", diff)
+				}
+			},
+		},
+		{
+			name: "role update",
+			dispatches: []func(t *testing.T, f *fixture){
+				func(t *testing.T, f *fixture) {
+					f.dispatch(t, "GUILD_ROLE_UPDATE", &discordgo.GuildRoleUpdate{GuildRole: &discordgo.GuildRole{
+						GuildID: guildID,
+						Role:    &discordgo.Role{ID: roleID, Name: "new"},
+					}})
+				},
+			},
+			want: []events.Type{events.GuildRoleUpdateType, events.CacophonyDiffRole},
+			check: func(t *testing.T, published []*events.Event) {
+				diff := published[1].DiffRole
+				if diff == nil || diff.Old == nil || diff.New == nil {
+					t.Fatalf("expected old and new role, got %+v", diff)
+				}
+				if diff.Old.Name != "old" || diff.New.Name != "new" {
+					t.Errorf("expected role name to change from old to new, got %q to %q", diff.Old.Name, diff.New.Name)
+				}
+			},
+		},
+		{
+			name: "role delete",
+			dispatches: []func(t *testing.T, f *fixture){
+				func(t *testing.T, f *fixture) {
+					f.dispatch(t, "GUILD_ROLE_DELETE", &discordgo.GuildRoleDelete{
+						GuildID: guildID,
+						RoleID:  roleID,
+					})
+				},
+			},
+			want: []events.Type{events.GuildRoleDeleteType, events.CacophonyDiffRole},
+			check: func(t *testing.T, published []*events.Event) {
+				diff := published[1].DiffRole
+				if diff == nil || diff.Old == nil || diff.New != nil {
+					t.Fatalf("expected only the old role, got %+v", diff)
+				}
+			},
+		},
+		{
+			name: "emojis update",
+			dispatches: []func(t *testing.T, f *fixture){
+				func(t *testing.T, f *fixture) {
+					f.dispatch(t, "GUILD_EMOJIS_UPDATE", &discordgo.GuildEmojisUpdate{
+						GuildID: guildID,
+						Emojis:  []*discordgo.Emoji{{ID: emojiID, Name: "new"}},
+					})
+				},
+			},
+			want: []events.Type{events.GuildEmojisUpdateType, events.CacophonyDiffEmoji},
+			check: func(t *testing.T, published []*events.Event) {
+				diff := published[1].DiffEmoji
+				if diff == nil || len(diff.Old) != 1 || len(diff.New) != 1 {
+					t.Fatalf("expected one old and one new emoji, got %+v", diff)
+				}
+				if diff.Old[0].Name != "old" || diff.New[0].Name != "new" {
+					t.Errorf("expected emoji name to change from old to new, got %q to %q",
+						diff.Old[0].Name, diff.New[0].Name)
+				}
+			},
+		},
+		{
+			name: "webhooks update",
+			setup: func(f *fixture) {
+				f.state.SetGuildWebhooks(guildID, []*discordgo.Webhook{
+					{ID: "700", GuildID: guildID, ChannelID: channelID, Name: "webhook"},
+				})
+			},
+			dispatches: []func(t *testing.T, f *fixture){
+				func(t *testing.T, f *fixture) {
+					f.dispatch(t, "WEBHOOKS_UPDATE", &discordgo.WebhooksUpdate{
+						GuildID:   guildID,
+						ChannelID: channelID,
+					})
+				},
+			},
+			want: []events.Type{events.WebhooksUpdateType, events.CacophonyDiffWebhooks},
+			check: func(t *testing.T, published []*events.Event) {
+				diff := published[1].DiffWebhooks
+				if diff == nil || len(diff.New) != 1 {
+					t.Fatalf("expected the new webhook, got %+v", diff)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t, tt.whitelist)
+			if !tt.notWhitelisted {
+				f.checker.Whitelist(guildID)
+			}
+			if tt.blacklisted {
+				f.checker.Blacklist(guildID)
+			}
+
+			f.dispatch(t, "GUILD_CREATE", &discordgo.GuildCreate{Guild: testGuild()})
+			f.published(t)
+
+			if tt.setup != nil {
+				tt.setup(f)
+			}
+			for _, dispatch := range tt.dispatches {
+				dispatch(t, f)
+			}
+
+			published := f.published(t)
+			var got []events.Type
+			for _, event := range published {
+				got = append(got, event.Type)
+
+				if event.BotUserID != botID {
+					t.Errorf("expected bot user ID %q on %s, got %q", botID, event.Type, event.BotUserID)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected published events %v, got %v", tt.want, got)
+			}
+
+			if tt.check != nil {
+				tt.check(t, published)
+			}
+		})
+	}
+}
+
+func TestEventHandlerNotWhitelistedUpdatesState(t *testing.T) {
+	f := newFixture(t, true)
+
+	f.dispatch(t, "GUILD_CREATE", &discordgo.GuildCreate{Guild: testGuild()})
+	f.dispatch(t, "GUILD_UPDATE", &discordgo.GuildUpdate{Guild: &discordgo.Guild{
+		ID:   guildID,
+		Name: "new",
+	}})
+
+	if published := f.published(t); len(published) != 0 {
+		t.Fatalf("expected no published events, got %d", len(published))
+	}
+
+	guild, err := f.state.Guild(guildID)
+	if err != nil {
+		t.Fatalf("expected guild in state: %v", err)
+	}
+	if guild.Name != "new" {
+		t.Errorf("expected guild name new, got %q", guild.Name)
+	}
+}
@@ -0,0 +1,65 @@
+package handlertest
+
+import (
+	"sync"
+)
+
+// Checker keeps the whitelist and blacklist in memory,
+// like whitelist.Checker every guild is whitelisted while the whitelist is not enabled
+type Checker struct {
+	lock      sync.RWMutex
+	enable    bool
+	whitelist map[string]bool
+	blacklist map[string]bool
+}
+
+// NewChecker creates a Checker without any whitelisted or blacklisted guilds
+func NewChecker(enable bool) *Checker {
+	return &Checker{
+		enable:    enable,
+		whitelist: make(map[string]bool),
+		blacklist: make(map[string]bool),
+	}
+}
+
+// Whitelist adds guilds to the whitelist
+func (c *Checker) Whitelist(guildIDs ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, guildID := range guildIDs {
+		c.whitelist[guildID] = true
+	}
+}
+
+// Blacklist adds guilds to the blacklist
+func (c *Checker) Blacklist(guildIDs ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, guildID := range guildIDs {
+		c.blacklist[guildID] = true
+	}
+}
+
+func (c *Checker) IsWhitelisted(guildID string) bool {
+	if !c.enable {
+		return true
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.whitelist[guildID]
+}
+
+func (c *Checker) IsBlacklisted(guildID string) bool {
+	if !c.enable {
+		return false
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.blacklist[guildID]
+}
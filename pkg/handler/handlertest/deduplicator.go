@@ -0,0 +1,38 @@
+package handlertest
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Deduplicator keeps the keys of seen events in memory, it only deduplicates within a single process
+type Deduplicator struct {
+	lock sync.Mutex
+	keys map[string]time.Time
+}
+
+// NewDeduplicator creates a Deduplicator which has not seen any events
+func NewDeduplicator() *Deduplicator {
+	return &Deduplicator{
+		keys: make(map[string]time.Time),
+	}
+}
+
+// IsDuplicate reports whether the key has been set before, and has not expired yet, and sets it otherwise
+func (d *Deduplicator) IsDuplicate(key string, expiration time.Duration) (bool, error) {
+	if key == "" {
+		return false, errors.New("passed key is empty")
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	if expires, ok := d.keys[key]; ok && now.Before(expires) {
+		return true, nil
+	}
+
+	d.keys[key] = now.Add(expiration)
+	return false, nil
+}
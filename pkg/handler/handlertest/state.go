@@ -0,0 +1,159 @@
+// Package handlertest provides in-memory implementations of the dependencies of the event handler,
+// to run it without Redis, the in-memory publisher is publisher.Memory.
+package handlertest
+
+import (
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// State keeps the shared state in memory, using the discordgo state.
+// Getters return copies, so objects read before an event can be compared with objects read after it, like diffs do.
+type State struct {
+	state *discordgo.State
+	// session enables the discordgo state, sessions of the gateway have it disabled
+	session *discordgo.Session
+
+	lock     sync.Mutex
+	bots     map[string]string
+	webhooks map[string][]*discordgo.Webhook
+}
+
+// NewState creates an empty State
+func NewState() *State {
+	return &State{
+		state:    discordgo.NewState(),
+		session:  &discordgo.Session{StateEnabled: true},
+		bots:     make(map[string]string),
+		webhooks: make(map[string][]*discordgo.Webhook),
+	}
+}
+
+// SharedStateEventHandler applies an event to the state, the bot receiving a GUILD_CREATE becomes the bot of the guild
+func (s *State) SharedStateEventHandler(session *discordgo.Session, i interface{}) error {
+	if guildCreate, ok := i.(*discordgo.GuildCreate); ok && session != nil && session.State != nil &&
+		session.State.User != nil {
+		s.lock.Lock()
+		if _, ok := s.bots[guildCreate.ID]; !ok {
+			s.bots[guildCreate.ID] = session.State.User.ID
+		}
+		s.lock.Unlock()
+	}
+
+	// the discordgo state keeps the guilds of a READY, and overwrites them on GUILD_CREATE,
+	// while the handler still requests their members, so it gets copies
+	if ready, ok := i.(*discordgo.Ready); ok {
+		readyCopy := *ready
+		readyCopy.Guilds = make([]*discordgo.Guild, 0, len(ready.Guilds))
+		for _, guild := range ready.Guilds {
+			guildCopy := *guild
+			readyCopy.Guilds = append(readyCopy.Guilds, &guildCopy)
+		}
+		i = &readyCopy
+	}
+
+	err := s.state.OnInterface(s.session, i)
+	// events for unknown objects are not an error of the shared state
+	if err == discordgo.ErrStateNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// Guild returns a copy of a guild
+func (s *State) Guild(guildID string) (*discordgo.Guild, error) {
+	guild, err := s.state.Guild(guildID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.state.RLock()
+	defer s.state.RUnlock()
+
+	guildCopy := *guild
+	guildCopy.Emojis = append([]*discordgo.Emoji(nil), guild.Emojis...)
+	guildCopy.Roles = append([]*discordgo.Role(nil), guild.Roles...)
+	guildCopy.Channels = append([]*discordgo.Channel(nil), guild.Channels...)
+
+	return &guildCopy, nil
+}
+
+// Member returns a copy of a member
+func (s *State) Member(guildID, userID string) (*discordgo.Member, error) {
+	member, err := s.state.Member(guildID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.state.RLock()
+	defer s.state.RUnlock()
+
+	memberCopy := *member
+	memberCopy.Roles = append([]string(nil), member.Roles...)
+
+	return &memberCopy, nil
+}
+
+// Channel returns a copy of a channel
+func (s *State) Channel(channelID string) (*discordgo.Channel, error) {
+	channel, err := s.state.Channel(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.state.RLock()
+	defer s.state.RUnlock()
+
+	channelCopy := *channel
+	channelCopy.PermissionOverwrites = append(
+		[]*discordgo.PermissionOverwrite(nil), channel.PermissionOverwrites...,
+	)
+
+	return &channelCopy, nil
+}
+
+// Role returns a copy of a role
+func (s *State) Role(guildID, roleID string) (*discordgo.Role, error) {
+	role, err := s.state.Role(guildID, roleID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.state.RLock()
+	defer s.state.RUnlock()
+
+	roleCopy := *role
+
+	return &roleCopy, nil
+}
+
+// GuildWebhooks returns the webhooks of a guild, see SetGuildWebhooks
+func (s *State) GuildWebhooks(guildID string) ([]*discordgo.Webhook, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]*discordgo.Webhook(nil), s.webhooks[guildID]...), nil
+}
+
+// SetGuildWebhooks sets the webhooks of a guild, the shared state requests them from Discord instead
+func (s *State) SetGuildWebhooks(guildID string, webhooks []*discordgo.Webhook) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.webhooks[guildID] = webhooks
+}
+
+// BotForGuild returns the first bot which received the guild, permissions are not checked
+func (s *State) BotForGuild(guildID string, _ ...int64) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	botID, ok := s.bots[guildID]
+	if !ok {
+		return "", discordgo.ErrStateNotFound
+	}
+
+	return botID, nil
+}
@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+// PublisherHealth describes the recent results of publishing events
+type PublisherHealth struct {
+	LastSuccess         time.Time `json:"last_success"`
+	LastFailure         time.Time `json:"last_failure"`
+	LastError           string    `json:"last_error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	// FailingSince is the time of the first failure after the last success
+	FailingSince time.Time `json:"failing_since"`
+}
+
+type publisherHealth struct {
+	lock   sync.RWMutex
+	health PublisherHealth
+}
+
+func (p *publisherHealth) record(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now().UTC()
+	if err == nil {
+		p.health.LastSuccess = now
+		p.health.ConsecutiveFailures = 0
+		p.health.FailingSince = time.Time{}
+		return
+	}
+
+	if p.health.ConsecutiveFailures == 0 {
+		p.health.FailingSince = now
+	}
+	p.health.LastFailure = now
+	p.health.LastError = err.Error()
+	p.health.ConsecutiveFailures++
+}
+
+// PublisherHealth returns the recent results of publishing events
+func (eh *EventHandler) PublisherHealth() PublisherHealth {
+	eh.publisherHealth.lock.RLock()
+	defer eh.publisherHealth.lock.RUnlock()
+
+	return eh.publisherHealth.health
+}
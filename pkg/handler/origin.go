@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"github.com/bwmarrin/discordgo"
+)
+
+// origin identifies the gateway dispatch an event has been received with,
+// consumers use it to detect gaps, and to order events
+type origin struct {
+	ShardID    int    `json:"shard_id"`
+	ShardCount int    `json:"shard_count"`
+	SessionID  string `json:"session_id,omitempty"`
+	Sequence   int64  `json:"sequence,omitempty"`
+
+	// Raw is the dispatch of RawType events
+	Raw *rawDispatch `json:"discord_raw,omitempty"`
+}
+
+// newOrigin returns the origin of a dispatch received by the session with the given session ID and sequence number
+func newOrigin(session *discordgo.Session, sessionID string, sequence int64) origin {
+	return origin{
+		ShardID:    session.ShardID,
+		ShardCount: session.ShardCount,
+		SessionID:  sessionID,
+		Sequence:   sequence,
+	}
+}
+
+// unwrapDispatch returns the event to handle for an item received by a session, and the raw dispatch it came with.
+// discordgo passes every dispatch twice, first the typed event, then the raw event wrapping it, which carries
+// the sequence number and payload, so typed events are handled once their raw event is received, and ok is false
+// before. Events generated by discordgo itself have no raw event.
+func unwrapDispatch(eventItem interface{}) (item interface{}, raw *discordgo.Event, ok bool) {
+	switch t := eventItem.(type) {
+	case *discordgo.Event:
+		if t.Struct != nil {
+			return t.Struct, t, true
+		}
+		// unknown dispatch types only have their raw event
+		return t, t, true
+	case *discordgo.Connect, *discordgo.Disconnect, *discordgo.RateLimit:
+		return eventItem, nil, true
+	}
+
+	return nil, nil, false
+}
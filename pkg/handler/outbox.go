@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"go.uber.org/zap"
+)
+
+// RedeliverOutbox publishes the events waiting in the outbox in order,
+// after a recoverable failure it waits for the given interval before retrying, it blocks forever
+func (eh *EventHandler) RedeliverOutbox(interval time.Duration) {
+	if eh.outbox == nil {
+		return
+	}
+
+	for {
+		time.Sleep(interval)
+
+		eh.redeliver()
+	}
+}
+
+// DrainOutbox publishes the events waiting in the outbox until it is empty, or the context is done,
+// it is called on shutdown, events left in the outbox are redelivered after the restart
+func (eh *EventHandler) DrainOutbox(ctx context.Context, interval time.Duration) {
+	if eh.outbox == nil {
+		return
+	}
+
+	for !eh.redeliver() {
+		select {
+		case <-ctx.Done():
+			eh.logger.Warn("unable to drain outbox before shutting down",
+				zap.Int("pending", eh.outbox.Pending()),
+			)
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// redeliver publishes the events waiting in the outbox in order, until one fails,
+// it returns true if the outbox has been drained
+func (eh *EventHandler) redeliver() bool {
+	eh.redeliverLock.Lock()
+	defer eh.redeliverLock.Unlock()
+
+	for {
+		body, err := eh.outbox.Peek()
+		if err != nil {
+			raven.CaptureError(err, nil)
+			eh.logger.Error("unable to read event from outbox", zap.Error(err))
+			return false
+		}
+		if body == nil {
+			return true
+		}
+
+		err, recoverable := eh.publisher.PublishRaw(eh.redeliveryContext(body), body)
+		eh.publisherHealth.record(err)
+		if err != nil && !recoverable {
+			// the event stays in the outbox, and is redelivered after the restart
+			raven.CaptureError(err, nil)
+			eh.logger.Fatal("unrecoverable publishing error, shutting down",
+				zap.Error(err),
+				zap.Int("pending", eh.outbox.Pending()),
+			)
+		}
+		if err != nil {
+			eh.logger.Warn("unable to redeliver event from outbox, retrying later",
+				zap.Error(err),
+				zap.Int("pending", eh.outbox.Pending()),
+			)
+			return false
+		}
+
+		err = eh.outbox.Ack()
+		if err != nil {
+			raven.CaptureError(err, nil)
+			eh.logger.Error("unable to acknowledge event in outbox", zap.Error(err))
+			return false
+		}
+	}
+}
+
+// redeliveryContext routes an event from the outbox again, as the routing is not persisted with it
+func (eh *EventHandler) redeliveryContext(body []byte) context.Context {
+	var event struct {
+		Type      string `json:"type"`
+		GuildID   string `json:"guild_id"`
+		BotUserID string `json:"bot_user_id"`
+	}
+	err := json.Unmarshal(body, &event)
+	if err != nil {
+		return context.Background()
+	}
+
+	// events to be dropped never make it into the outbox
+	ctx, _ := eh.route(context.Background(), event.Type, event.GuildID, event.BotUserID)
+
+	return ctx
+}
@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"gitlab.com/Cacophony/Gateway/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// pipeline publishes events asynchronously, in batches.
+// Events are distributed across lanes by their ordering key, each lane publishes its events in order,
+// so events of the same guild are never reordered.
+type pipeline struct {
+	eh           *EventHandler
+	lanes        []chan *outgoing
+	batchSize    int
+	batchTimeout time.Duration
+
+	wg sync.WaitGroup
+}
+
+// StartPipeline publishes events asynchronously from now on, using the given number of lanes,
+// each buffering up to buffer events, which are published in batches of up to batchSize events,
+// or whatever has been buffered after batchTimeout.
+// Events are published synchronously if it is not called.
+func (eh *EventHandler) StartPipeline(lanes, buffer, batchSize int, batchTimeout time.Duration) {
+	if lanes < 1 {
+		lanes = 1
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	p := &pipeline{
+		eh:           eh,
+		lanes:        make([]chan *outgoing, lanes),
+		batchSize:    batchSize,
+		batchTimeout: batchTimeout,
+	}
+	for i := range p.lanes {
+		p.lanes[i] = make(chan *outgoing, buffer)
+
+		p.wg.Add(1)
+		go p.run(p.lanes[i])
+	}
+
+	eh.pipeline = p
+}
+
+// Close handles the events still queued, and publishes the events remaining in the pipeline,
+// it must be called after all sessions have been closed
+func (eh *EventHandler) Close() {
+	eh.workers.close()
+
+	if eh.pipeline == nil {
+		return
+	}
+
+	for _, lane := range eh.pipeline.lanes {
+		close(lane)
+	}
+	eh.pipeline.wg.Wait()
+}
+
+// enqueue adds an event to its lane, blocking while the lane is full
+func (p *pipeline) enqueue(message *outgoing) {
+	lane := p.lanes[laneIndex(message.key, len(p.lanes))]
+
+	metrics.PublishQueueDepth.Inc()
+	select {
+	case lane <- message:
+		return
+	default:
+	}
+
+	// the broker cannot keep up, slow down reading events from Discord
+	metrics.PublishBlocked.Inc()
+	start := time.Now()
+	lane <- message
+	metrics.PublishBackpressure.Add(time.Since(start).Seconds())
+}
+
+// run publishes the events of a lane, until the lane is closed
+func (p *pipeline) run(lane chan *outgoing) {
+	defer p.wg.Done()
+
+	batch := make([]*outgoing, 0, p.batchSize)
+	for {
+		message, ok := <-lane
+		if !ok {
+			return
+		}
+		batch = append(batch, message)
+
+		// collect whatever arrives until the batch is full, or the timeout has passed
+		timeout := time.NewTimer(p.batchTimeout)
+	collect:
+		for len(batch) < p.batchSize {
+			select {
+			case message, ok = <-lane:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, message)
+			case <-timeout.C:
+				break collect
+			}
+		}
+		timeout.Stop()
+
+		p.deliver(batch)
+		batch = batch[:0]
+
+		if !ok {
+			return
+		}
+	}
+}
+
+func (p *pipeline) deliver(batch []*outgoing) {
+	metrics.PublishBatchSize.Observe(float64(len(batch)))
+
+	err, recoverable := p.eh.deliver(batch)
+	metrics.PublishQueueDepth.Sub(float64(len(batch)))
+	for _, message := range batch {
+		if message.delivered != nil {
+			message.delivered <- err
+		}
+	}
+	if err == nil {
+		return
+	}
+
+	raven.CaptureError(err, nil)
+	if !recoverable {
+		p.eh.logger.Fatal("unrecoverable publishing error, shutting down",
+			zap.Error(err),
+		)
+	}
+	p.eh.logger.Error("unable to publish events",
+		zap.Error(err),
+		zap.Int("events", len(batch)),
+	)
+}
+
+// laneIndex returns the lane for an ordering key
+func laneIndex(key string, lanes int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key)) // nolint: errcheck
+
+	return int(hash.Sum32() % uint32(lanes))
+}
@@ -0,0 +1,269 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"gitlab.com/Cacophony/Gateway/pkg/metrics"
+	"gitlab.com/Cacophony/Gateway/pkg/routing"
+	"gitlab.com/Cacophony/go-kit/events"
+	"go.uber.org/zap"
+)
+
+// shardEvent is the published representation of an event,
+// it includes the shard, session, and sequence number of the dispatch the event has been received with,
+// diff events share those of the event they have been generated for
+type shardEvent struct {
+	*events.Event
+	origin
+}
+
+// outgoing is a serialised event on its way to the publisher
+type outgoing struct {
+	Message
+	eventType string
+	eventID   string
+	botID     string
+	// key is the ordering key of the event, events with the same key are published in order
+	key string
+	// delivered receives the result of delivering the event, if set, see deliverConfirmed
+	delivered chan error
+}
+
+func (eh *EventHandler) publish(
+	ctx context.Context,
+	session *discordgo.Session,
+	source origin,
+	event *events.Event,
+) (err error, recoverable bool) { // nolint: golint
+	message, err := eh.prepare(ctx, session, source, event)
+	if err != nil {
+		return err, true
+	}
+	if message == nil {
+		return nil, true
+	}
+
+	if eh.pipeline != nil {
+		eh.pipeline.enqueue(message)
+		return nil, true
+	}
+
+	return eh.deliver([]*outgoing{message})
+}
+
+// deliverConfirmed publishes an event, and waits until it has been delivered, also when publishing asynchronously,
+// it returns ErrDropped if the event is filtered, or dropped by the routing table
+func (eh *EventHandler) deliverConfirmed(
+	ctx context.Context,
+	session *discordgo.Session,
+	source origin,
+	event *events.Event,
+) error {
+	message, err := eh.prepare(ctx, session, source, event)
+	if err != nil {
+		return err
+	}
+	if message == nil {
+		return ErrDropped
+	}
+
+	if eh.pipeline != nil {
+		message.delivered = make(chan error, 1)
+		eh.pipeline.enqueue(message)
+		return <-message.delivered
+	}
+
+	err, _ = eh.deliver([]*outgoing{message})
+	return err
+}
+
+// prepare serialises an event for publishing, it returns nil if the event is filtered, or dropped by the routing table
+func (eh *EventHandler) prepare(
+	ctx context.Context,
+	session *discordgo.Session,
+	source origin,
+	event *events.Event,
+) (*outgoing, error) {
+	if event.BotUserID == "" {
+		// diff events are not generated from discord events, so they lack the bot
+		event.BotUserID = session.State.User.ID
+	}
+
+	if eh.filter != nil && !eh.filter.Allowed(string(event.Type), event.GuildID, event.ChannelID, event.BotUserID) {
+		metrics.EventsDropped.WithLabelValues(metrics.DropFiltered, string(event.Type)).Inc()
+		return nil, nil
+	}
+
+	ctx, drop := eh.route(ctx, string(event.Type), event.GuildID, event.BotUserID)
+	if drop {
+		metrics.EventsDropped.WithLabelValues(metrics.DropRouted, string(event.Type)).Inc()
+		return nil, nil
+	}
+
+	body, err := json.Marshal(&shardEvent{
+		Event:  event,
+		origin: source,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshalling event")
+	}
+
+	return &outgoing{
+		Message: Message{
+			Context: ctx,
+			Body:    body,
+		},
+		eventType: string(event.Type),
+		eventID:   event.ID,
+		botID:     event.BotUserID,
+		key:       orderingKey(event),
+	}, nil
+}
+
+// deliver publishes a batch of events in order,
+// events which could not be published are written to the outbox, if there is one
+func (eh *EventHandler) deliver(batch []*outgoing) (err error, recoverable bool) { // nolint: golint
+	// keep events in order, while older events are waiting in the outbox
+	if eh.outbox != nil && eh.outbox.Pending() > 0 {
+		return eh.writeOutbox(batch, nil, true)
+	}
+
+	start := time.Now()
+	confirmed := 0
+	recoverable = true
+	if batchPublisher, ok := eh.publisher.(BatchPublisher); ok && len(batch) > 1 {
+		messages := make([]Message, 0, len(batch))
+		for _, message := range batch {
+			messages = append(messages, message.Message)
+		}
+
+		confirmed, err, recoverable = batchPublisher.PublishBatch(messages)
+	} else {
+		for _, message := range batch {
+			err, recoverable = eh.publisher.PublishRaw(message.Context, message.Body)
+			if err != nil {
+				break
+			}
+			confirmed++
+		}
+	}
+	if err == nil {
+		confirmed = len(batch)
+	}
+	duration := time.Since(start).Seconds() / float64(len(batch))
+	eh.publisherHealth.record(err)
+
+	for i, message := range batch {
+		metrics.PublishDuration.WithLabelValues(message.eventType).Observe(duration)
+		if i < confirmed {
+			metrics.EventsPublished.WithLabelValues(message.eventType, message.botID).Inc()
+		} else {
+			metrics.PublishErrors.WithLabelValues(message.eventType).Inc()
+		}
+	}
+
+	if err == nil {
+		return nil, true
+	}
+	if eh.outbox == nil {
+		return err, recoverable
+	}
+
+	// confirmed events are not written to the outbox, so they are not published twice
+	return eh.writeOutbox(batch[confirmed:], err, recoverable)
+}
+
+// writeOutbox appends events to the outbox, publishErr is the error which prevented publishing them, if any,
+// unrecoverable errors are still returned, the events will be redelivered after the restart
+func (eh *EventHandler) writeOutbox(batch []*outgoing, publishErr error, recoverable bool) (error, bool) { // nolint: golint
+	for _, message := range batch {
+		err := eh.outbox.Append(message.Body)
+		if err != nil {
+			if publishErr != nil {
+				err = errors.Wrap(publishErr, "error writing event to outbox: "+err.Error())
+			}
+			return errors.Wrap(err, "error writing event to outbox"), recoverable
+		}
+
+		if publishErr != nil {
+			eh.logger.Warn("unable to publish event, written to outbox",
+				zap.Error(publishErr),
+				zap.String("event_id", message.eventID),
+				zap.Bool("recoverable", recoverable),
+			)
+		}
+	}
+
+	if !recoverable {
+		return publishErr, false
+	}
+
+	return nil, true
+}
+
+// route applies the first matching route of the routing table to the publishing context,
+// it returns true if the event should be dropped
+func (eh *EventHandler) route(
+	ctx context.Context,
+	eventType, guildID, botID string,
+) (context.Context, bool) {
+	route := eh.routes.Match(eventType, guildID, botID)
+	if route == nil {
+		return ctx, false
+	}
+	if route.Drop {
+		return ctx, true
+	}
+
+	if route.Topic != "" {
+		ctx = routing.WithKey(ctx, route.Topic)
+	}
+	if route.Priority > 0 {
+		ctx = routing.WithPriority(ctx, route.Priority)
+	}
+
+	return ctx, false
+}
+
+// dispatchKey returns the key dispatches are handled in order by, the guild, or the channel for direct messages,
+// it is read from the payload, so dispatches which are not converted into events keep the order of their guild too
+func dispatchKey(botID string, raw *discordgo.Event) string {
+	var payload struct {
+		ID        string `json:"id"`
+		GuildID   string `json:"guild_id"`
+		ChannelID string `json:"channel_id"`
+	}
+	json.Unmarshal(raw.RawData, &payload) // nolint: errcheck
+
+	switch {
+	case payload.GuildID != "":
+		return payload.GuildID
+	case strings.HasPrefix(raw.Type, "GUILD_") && payload.ID != "":
+		// guild create, update, and delete dispatches are the guild itself
+		return payload.ID
+	case payload.ChannelID != "":
+		return payload.ChannelID
+	case strings.HasPrefix(raw.Type, "CHANNEL_") && payload.ID != "":
+		// channel dispatches of direct message channels are the channel itself
+		return payload.ID
+	}
+
+	return botID
+}
+
+// orderingKey returns the key events are ordered by, the guild, or the channel for direct messages
+func orderingKey(event *events.Event) string {
+	if event.GuildID != "" {
+		return event.GuildID
+	}
+	if event.ChannelID != "" {
+		return event.ChannelID
+	}
+
+	return event.BotUserID
+}
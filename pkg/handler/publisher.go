@@ -0,0 +1,24 @@
+package handler
+
+import (
+	"context"
+)
+
+// Publisher publishes serialised events to a message broker, see the publisher package for implementations,
+// recoverable is false if the publisher cannot be used anymore
+type Publisher interface {
+	PublishRaw(ctx context.Context, body []byte) (err error, recoverable bool) // nolint: golint
+}
+
+// Message is a serialised event, with the context to publish it with, see the routing package
+type Message struct {
+	Context context.Context
+	Body    []byte
+}
+
+// BatchPublisher is implemented by publishers which publish multiple events at once more efficiently,
+// messages must be published in order, and the call must only return once all of them have been confirmed,
+// confirmed is the number of messages from the start of the batch which have been confirmed, also on errors
+type BatchPublisher interface {
+	PublishBatch(messages []Message) (confirmed int, err error, recoverable bool) // nolint: golint
+}
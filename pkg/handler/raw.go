@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"gitlab.com/Cacophony/go-kit/events"
+)
+
+// RawType is the type of events published for dispatches the events package cannot convert,
+// see EnableRawPassthrough
+const RawType events.Type = "discord_raw"
+
+// rawDispatch is the name and payload of a dispatch, as received from Discord
+type rawDispatch struct {
+	Name    string          `json:"name"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// EnableRawPassthrough publishes dispatches of types the events package cannot convert as RawType events,
+// with their name and payload, instead of storing them as dead letters.
+// This allows consumers to handle new Discord features before the events package supports them.
+func (eh *EventHandler) EnableRawPassthrough() {
+	eh.rawPassthrough = true
+}
+
+// rawEvent creates a generic event for a dispatch, the guild, channel, and user are taken from the payload if present
+func rawEvent(botID string, raw *discordgo.Event) (*events.Event, time.Duration, error) {
+	event, err := events.New(RawType)
+	if err != nil {
+		return nil, 0, err
+	}
+	event.ReceivedAt = event.ReceivedAt.UTC()
+	event.BotUserID = botID
+
+	var ids struct {
+		GuildID   string `json:"guild_id"`
+		ChannelID string `json:"channel_id"`
+		UserID    string `json:"user_id"`
+	}
+	// not every payload is an object, those are published without IDs
+	json.Unmarshal(raw.RawData, &ids) // nolint: errcheck
+	event.GuildID = ids.GuildID
+	event.ChannelID = ids.ChannelID
+	event.UserID = ids.UserID
+
+	// identical dispatches received by multiple sessions are deduplicated like other events
+	sum := sha256.Sum256(append([]byte(raw.Type), raw.RawData...))
+	event.CacheKey = hex.EncodeToString(sum[:])
+
+	return event, 500 * time.Millisecond, nil
+}
@@ -0,0 +1,10 @@
+package handler
+
+import (
+	"gitlab.com/Cacophony/Gateway/pkg/recording"
+)
+
+// Record writes every dispatch received from now on to the recorder, see the replay command
+func (eh *EventHandler) Record(recorder *recording.Recorder) {
+	eh.recorder = recorder
+}
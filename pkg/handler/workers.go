@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"sync"
+
+	"gitlab.com/Cacophony/Gateway/pkg/metrics"
+)
+
+// workers handles events concurrently, events with the same key are always handled by the same worker,
+// in the order they have been dispatched in
+type workers struct {
+	queues []chan func()
+
+	wg sync.WaitGroup
+}
+
+// StartWorkers handles events with the given number of workers from now on, each queueing up to buffer events,
+// dispatching blocks while the queue of the worker is full.
+// Events are handled on the goroutine of the session if it is not called.
+func (eh *EventHandler) StartWorkers(count, buffer int) {
+	if count < 1 {
+		return
+	}
+
+	w := &workers{
+		queues: make([]chan func(), count),
+	}
+	for i := range w.queues {
+		w.queues[i] = make(chan func(), buffer)
+
+		w.wg.Add(1)
+		go w.run(w.queues[i])
+	}
+
+	eh.workers = w
+}
+
+// dispatch queues a function on the worker for the given key, or runs it directly without workers
+func (w *workers) dispatch(key string, fn func()) {
+	if w == nil {
+		fn()
+		return
+	}
+
+	metrics.HandlerQueueDepth.Inc()
+	w.queues[laneIndex(key, len(w.queues))] <- fn
+}
+
+func (w *workers) run(queue chan func()) {
+	defer w.wg.Done()
+
+	for fn := range queue {
+		fn()
+		metrics.HandlerQueueDepth.Dec()
+	}
+}
+
+// close handles the queued events, and stops the workers
+func (w *workers) close() {
+	if w == nil {
+		return
+	}
+
+	for _, queue := range w.queues {
+		close(queue)
+	}
+	w.wg.Wait()
+}
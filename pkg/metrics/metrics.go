@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	namespace = "cacophony"
+	subsystem = "gateway"
+)
+
+// reasons for events being dropped
+const (
+	DropBlacklisted    = "blacklisted"
+	DropNotWhitelisted = "not_whitelisted"
+	DropDuplicate      = "duplicate"
+	DropRouted         = "routed"
+	DropFiltered       = "filtered"
+)
+
+var (
+	// EventsReceived counts events received from Discord
+	EventsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "events_received_total",
+		Help:      "Events received from Discord, by event type and bot.",
+	}, []string{"type", "bot_id"})
+
+	// EventsPublished counts events published, including diff events
+	EventsPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "events_published_total",
+		Help:      "Events published, by event type and bot.",
+	}, []string{"type", "bot_id"})
+
+	// PublishErrors counts events which could not be published
+	PublishErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "publish_errors_total",
+		Help:      "Events which could not be published, by event type.",
+	}, []string{"type"})
+
+	// EventsDropped counts events which have not been published on purpose
+	EventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "events_dropped_total",
+		Help:      "Events which have not been published, by reason and event type.",
+	}, []string{"reason", "type"})
+
+	// DiffEvents counts diff events generated
+	DiffEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "diff_events_total",
+		Help:      "Diff events generated, by kind.",
+	}, []string{"kind"})
+
+	// PublishDuration observes the time it takes to publish an event
+	PublishDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "publish_duration_seconds",
+		Help:      "Time it takes to publish an event, by event type.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"type"})
+
+	// StateErrors counts failures of the shared state to handle an event
+	StateErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "state_errors_total",
+		Help:      "Events the shared state failed to handle.",
+	})
+
+	// OutboxDepth is the number of events waiting in the outbox
+	OutboxDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "outbox_depth",
+		Help:      "Events waiting in the outbox for redelivery.",
+	})
+
+	// OutboxBytes is the size of the events waiting in the outbox
+	OutboxBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "outbox_bytes",
+		Help:      "Size of the events waiting in the outbox for redelivery.",
+	})
+
+	// OutboxAppended counts events written to the outbox
+	OutboxAppended = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "outbox_appended_total",
+		Help:      "Events written to the outbox.",
+	})
+
+	// OutboxRedelivered counts events published from the outbox
+	OutboxRedelivered = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "outbox_redelivered_total",
+		Help:      "Events redelivered from the outbox.",
+	})
+
+	// OutboxDropped counts events lost, because the outbox was full
+	OutboxDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "outbox_dropped_total",
+		Help:      "Events which could not be written to the full outbox.",
+	})
+
+	// PublishQueueDepth is the number of events waiting to be published
+	PublishQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "publish_queue_depth",
+		Help:      "Events buffered in the publish pipeline.",
+	})
+
+	// PublishBackpressure counts the time spent waiting for room in the publish pipeline
+	PublishBackpressure = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "publish_backpressure_seconds_total",
+		Help:      "Time spent waiting for room in the full publish pipeline.",
+	})
+
+	// PublishBlocked counts events which had to wait for room in the publish pipeline
+	PublishBlocked = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "publish_blocked_total",
+		Help:      "Events which had to wait for room in the full publish pipeline.",
+	})
+
+	// PublishBatchSize observes the number of events published at once
+	PublishBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "publish_batch_size",
+		Help:      "Events published in a single batch.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+	})
+
+	// HandlerQueueDepth is the number of events waiting to be handled
+	HandlerQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "handler_queue_depth",
+		Help:      "Events received from Discord, waiting for a worker to handle them.",
+	})
+
+	// DeadLetters counts dispatches which could not be converted into events, and have been stored as dead letters
+	DeadLetters = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "dead_letters_total",
+		Help:      "Dispatches which could not be converted into events, by dispatch type.",
+	}, []string{"type"})
+)
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ShardHeartbeat is the latest heartbeat measurement of a shard
+type ShardHeartbeat struct {
+	BotID          string
+	ShardID        int
+	Connected      bool
+	LatencySeconds float64
+	AckAgeSeconds  float64
+}
+
+var (
+	heartbeatLatencyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "heartbeat_latency_seconds"),
+		"Latency between the last heartbeat and its ACK, by bot and shard.",
+		[]string{"bot_id", "shard_id"}, nil,
+	)
+	heartbeatAckAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "heartbeat_ack_age_seconds"),
+		"Time since the last heartbeat ACK, by bot and shard.",
+		[]string{"bot_id", "shard_id"}, nil,
+	)
+	shardConnectedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "shard_connected"),
+		"Whether a shard is connected, by bot and shard.",
+		[]string{"bot_id", "shard_id"}, nil,
+	)
+)
+
+// shardCollector collects the heartbeats of all shards on every scrape
+type shardCollector struct {
+	heartbeats func() []ShardHeartbeat
+}
+
+// RegisterShards registers a collector for the heartbeats returned by the given function
+func RegisterShards(heartbeats func() []ShardHeartbeat) {
+	prometheus.MustRegister(&shardCollector{
+		heartbeats: heartbeats,
+	})
+}
+
+func (c *shardCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- heartbeatLatencyDesc
+	ch <- heartbeatAckAgeDesc
+	ch <- shardConnectedDesc
+}
+
+func (c *shardCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, heartbeat := range c.heartbeats() {
+		shardID := strconv.Itoa(heartbeat.ShardID)
+
+		var connected float64
+		if heartbeat.Connected {
+			connected = 1
+		}
+		ch <- prometheus.MustNewConstMetric(shardConnectedDesc, prometheus.GaugeValue, connected, heartbeat.BotID, shardID)
+
+		if !heartbeat.Connected {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(heartbeatLatencyDesc, prometheus.GaugeValue, heartbeat.LatencySeconds, heartbeat.BotID, shardID)
+		ch <- prometheus.MustNewConstMetric(heartbeatAckAgeDesc, prometheus.GaugeValue, heartbeat.AckAgeSeconds, heartbeat.BotID, shardID)
+	}
+}
@@ -0,0 +1,283 @@
+package outbox
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"gitlab.com/Cacophony/Gateway/pkg/metrics"
+)
+
+const (
+	logFile    = "outbox.log"
+	offsetFile = "outbox.offset"
+
+	// headerSize is the size of the length prefix of every record
+	headerSize = 4
+)
+
+// ErrFull is returned if appending a record would exceed the maximum size of the outbox
+var ErrFull = errors.New("outbox is full")
+
+// Outbox is an append-only queue of records on disk, records are read in the order they have been appended.
+// The log contains length prefixed records, the offset file contains the position of the first unread record.
+type Outbox struct {
+	dir      string
+	maxBytes int64
+
+	lock    sync.Mutex
+	log     *os.File
+	offset  int64
+	size    int64
+	pending int
+}
+
+// Open opens the outbox in the given directory, creating it if necessary,
+// the log is limited to maxBytes, including records which have been read already, but not compacted yet
+func Open(dir string, maxBytes int64) (*Outbox, error) {
+	err := os.MkdirAll(dir, 0o750)
+	if err != nil {
+		return nil, err
+	}
+
+	log, err := os.OpenFile(filepath.Join(dir, logFile), os.O_RDWR|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &Outbox{
+		dir:      dir,
+		maxBytes: maxBytes,
+		log:      log,
+	}
+
+	o.offset, err = o.readOffset()
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+
+	err = o.scan()
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+
+	o.updateMetrics()
+	return o, nil
+}
+
+// Append adds a record to the end of the outbox, and syncs it to disk
+func (o *Outbox) Append(record []byte) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.size+headerSize+int64(len(record)) > o.maxBytes {
+		metrics.OutboxDropped.Inc()
+		return ErrFull
+	}
+
+	buf := make([]byte, headerSize+len(record))
+	binary.BigEndian.PutUint32(buf, uint32(len(record)))
+	copy(buf[headerSize:], record)
+
+	_, err := o.log.WriteAt(buf, o.size)
+	if err != nil {
+		return err
+	}
+	err = o.log.Sync()
+	if err != nil {
+		return err
+	}
+
+	o.size += int64(len(buf))
+	o.pending++
+	metrics.OutboxAppended.Inc()
+	o.updateMetrics()
+
+	return nil
+}
+
+// Peek returns the first unread record, or nil if there is none
+func (o *Outbox) Peek() ([]byte, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.pending == 0 {
+		return nil, nil
+	}
+
+	header := make([]byte, headerSize)
+	_, err := o.log.ReadAt(header, o.offset)
+	if err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, binary.BigEndian.Uint32(header))
+	_, err = o.log.ReadAt(record, o.offset+headerSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// Ack marks the first unread record as read, the log is compacted once it has been read completely,
+// or once half of its maximum size has been read
+func (o *Outbox) Ack() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.pending == 0 {
+		return nil
+	}
+
+	header := make([]byte, headerSize)
+	_, err := o.log.ReadAt(header, o.offset)
+	if err != nil {
+		return err
+	}
+
+	o.offset += headerSize + int64(binary.BigEndian.Uint32(header))
+	o.pending--
+	metrics.OutboxRedelivered.Inc()
+
+	if o.pending == 0 || o.offset >= o.maxBytes/2 {
+		err = o.compact()
+	} else {
+		err = o.writeOffset()
+	}
+	o.updateMetrics()
+
+	return err
+}
+
+// Pending returns the number of unread records
+func (o *Outbox) Pending() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	return o.pending
+}
+
+// Close closes the log
+func (o *Outbox) Close() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	return o.log.Close()
+}
+
+// scan counts the unread records, and truncates a partially written record at the end of the log
+func (o *Outbox) scan() error {
+	info, err := o.log.Stat()
+	if err != nil {
+		return err
+	}
+	end := info.Size()
+
+	if o.offset > end {
+		o.offset = end
+	}
+
+	header := make([]byte, headerSize)
+	position := o.offset
+	for position+headerSize <= end {
+		_, err = o.log.ReadAt(header, position)
+		if err != nil {
+			return err
+		}
+
+		next := position + headerSize + int64(binary.BigEndian.Uint32(header))
+		if next > end {
+			break
+		}
+
+		position = next
+		o.pending++
+	}
+
+	if position < end {
+		err = o.log.Truncate(position)
+		if err != nil {
+			return err
+		}
+	}
+	o.size = position
+
+	return nil
+}
+
+// compact moves the unread records to the start of the log, the caller must hold the lock
+func (o *Outbox) compact() error {
+	remaining := make([]byte, o.size-o.offset)
+	_, err := o.log.ReadAt(remaining, o.offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	// write the compacted log next to the current one, so a crash leaves either of them intact
+	path := filepath.Join(o.dir, logFile)
+	compacted, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	_, err = compacted.Write(remaining)
+	if err == nil {
+		err = compacted.Sync()
+	}
+	if err != nil {
+		compacted.Close()
+		return err
+	}
+
+	// reset the offset first, a crash before the rename redelivers read records, instead of skipping unread ones
+	o.offset = 0
+	err = o.writeOffset()
+	if err != nil {
+		compacted.Close()
+		return err
+	}
+
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		compacted.Close()
+		return err
+	}
+
+	o.log.Close()
+	o.log = compacted
+	o.size = int64(len(remaining))
+
+	return nil
+}
+
+func (o *Outbox) readOffset() (int64, error) {
+	data, err := os.ReadFile(filepath.Join(o.dir, offsetFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 8 {
+		return 0, nil
+	}
+
+	return int64(binary.BigEndian.Uint64(data)), nil
+}
+
+func (o *Outbox) writeOffset() error {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(o.offset))
+
+	return os.WriteFile(filepath.Join(o.dir, offsetFile), data, 0o640)
+}
+
+func (o *Outbox) updateMetrics() {
+	metrics.OutboxDepth.Set(float64(o.pending))
+	metrics.OutboxBytes.Set(float64(o.size - o.offset))
+}
@@ -0,0 +1,169 @@
+package publisher
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+	"gitlab.com/Cacophony/Gateway/pkg/handler"
+	"gitlab.com/Cacophony/Gateway/pkg/routing"
+)
+
+// confirmTimeout is the time to wait for the broker to confirm a batch
+const confirmTimeout = 30 * time.Second
+
+// AMQP publishes events to the cacophony fanout exchange, and waits for publisher confirms.
+// Events with a routing key are published to a fanout exchange of that name instead, declared on first use,
+// consumers of a route bind their queue to its exchange, like consumers of all other events bind to cacophony.
+// Priorities are only applied by queues declared with the x-max-priority argument, other queues ignore them.
+type AMQP struct {
+	conn *amqp.Connection
+
+	lock     sync.Mutex
+	channel  *amqp.Channel
+	confirms chan amqp.Confirmation
+	// declared are the exchanges declared so far
+	declared map[string]bool
+}
+
+// NewAMQP connects to the broker, and declares the exchange
+func NewAMQP(dsn string) (*AMQP, error) {
+	conn, err := amqp.Dial(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &AMQP{
+		conn:     conn,
+		declared: make(map[string]bool),
+	}
+
+	err = p.open()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// matches the exchange declared by the go-kit publisher and consumers
+	err = p.declare(defaultTopic)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *AMQP) PublishRaw( // nolint: golint
+	ctx context.Context,
+	body []byte,
+) (err error, recoverable bool) {
+	_, err, recoverable = p.PublishBatch([]handler.Message{{Context: ctx, Body: body}})
+	return err, recoverable
+}
+
+// PublishBatch publishes all messages, and waits until the broker confirmed all of them
+func (p *AMQP) PublishBatch( // nolint: golint
+	messages []handler.Message,
+) (confirmed int, err error, recoverable bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, message := range messages {
+		exchange := routing.Key(message.Context)
+		if exchange == "" {
+			exchange = defaultTopic
+		}
+
+		err = p.declare(exchange)
+		if err != nil {
+			// a failed declaration closes the channel
+			return 0, err, p.reopen()
+		}
+
+		err = p.channel.Publish(exchange, "", false, false, amqp.Publishing{
+			Body:     message.Body,
+			Priority: routing.Priority(message.Context),
+		})
+		if err != nil {
+			// the confirms of the messages published so far would be attributed to the next batch
+			return 0, err, p.reopen()
+		}
+	}
+
+	timeout := time.NewTimer(confirmTimeout)
+	defer timeout.Stop()
+
+	// confirms are delivered in the order of publishing
+	nacked := false
+	for range messages {
+		select {
+		case confirmation, ok := <-p.confirms:
+			if !ok {
+				return confirmed, amqp.ErrClosed, false
+			}
+			if !confirmation.Ack {
+				nacked = true
+			}
+			if !nacked {
+				confirmed++
+			}
+		case <-timeout.C:
+			// the remaining confirms of this batch would be attributed to the next one
+			return confirmed, errors.New("timed out waiting for publisher confirms"), p.reopen()
+		}
+	}
+	if nacked {
+		return confirmed, errors.Errorf("broker rejected events after %d of %d events", confirmed, len(messages)), true
+	}
+
+	return confirmed, nil, true
+}
+
+// declare declares a durable fanout exchange, unless it has been declared before, the caller must hold the lock
+func (p *AMQP) declare(exchange string) error {
+	if p.declared[exchange] {
+		return nil
+	}
+
+	err := p.channel.ExchangeDeclare(exchange, "fanout", true, false, false, false, nil)
+	if err != nil {
+		return errors.Wrapf(err, "cannot declare exchange %s", exchange)
+	}
+	p.declared[exchange] = true
+
+	return nil
+}
+
+// open opens a channel with publisher confirms, the caller must hold the lock
+func (p *AMQP) open() error {
+	channel, err := p.conn.Channel()
+	if err != nil {
+		return errors.Wrap(err, "cannot open channel")
+	}
+
+	err = channel.Confirm(false)
+	if err != nil {
+		channel.Close()
+		return errors.Wrap(err, "cannot enable publisher confirms")
+	}
+
+	p.channel = channel
+	p.confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 1000))
+
+	return nil
+}
+
+// reopen replaces the channel once its confirms got out of sync with the published messages,
+// it returns false if the connection cannot be used anymore
+func (p *AMQP) reopen() bool {
+	p.channel.Close() // nolint: errcheck
+
+	if p.conn.IsClosed() {
+		return false
+	}
+
+	return p.open() == nil
+}
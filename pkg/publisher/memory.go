@@ -0,0 +1,105 @@
+package publisher
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"gitlab.com/Cacophony/Gateway/pkg/handler"
+	"gitlab.com/Cacophony/Gateway/pkg/routing"
+	"gitlab.com/Cacophony/go-kit/events"
+)
+
+// Message is an event published to the Memory publisher
+type Message struct {
+	Body       []byte
+	RoutingKey string
+	Priority   uint8
+}
+
+// Memory keeps all published events in memory, it is meant for development and tests
+type Memory struct {
+	lock     sync.Mutex
+	messages []Message
+}
+
+// NewMemory creates a new Memory publisher
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (p *Memory) PublishRaw( // nolint: golint
+	ctx context.Context,
+	body []byte,
+) (err error, recoverable bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.messages = append(p.messages, Message{
+		Body:       append([]byte(nil), body...),
+		RoutingKey: routing.Key(ctx),
+		Priority:   routing.Priority(ctx),
+	})
+
+	return nil, true
+}
+
+// PublishBatch keeps all messages, in order
+func (p *Memory) PublishBatch( // nolint: golint
+	messages []handler.Message,
+) (confirmed int, err error, recoverable bool) {
+	for _, message := range messages {
+		p.PublishRaw(message.Context, message.Body) // nolint: errcheck
+	}
+
+	return len(messages), nil, true
+}
+
+// Messages returns all published messages, in order
+func (p *Memory) Messages() []Message {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	messages := make([]Message, len(p.messages))
+	copy(messages, p.messages)
+
+	return messages
+}
+
+// Published returns the bodies of all published events, in order
+func (p *Memory) Published() [][]byte {
+	messages := p.Messages()
+
+	published := make([][]byte, 0, len(messages))
+	for _, message := range messages {
+		published = append(published, message.Body)
+	}
+
+	return published
+}
+
+// Events returns all published events, in order
+func (p *Memory) Events() ([]*events.Event, error) {
+	published := p.Published()
+
+	result := make([]*events.Event, 0, len(published))
+	for _, body := range published {
+		var event events.Event
+		err := json.Unmarshal(body, &event)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, &event)
+	}
+
+	return result, nil
+}
+
+// Reset forgets all published events
+func (p *Memory) Reset() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.messages = nil
+}
@@ -0,0 +1,101 @@
+package publisher
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"gitlab.com/Cacophony/Gateway/pkg/handler"
+	"gitlab.com/Cacophony/Gateway/pkg/routing"
+)
+
+// RedisStreams publishes events by appending them to Redis streams,
+// the stream name may contain {type} and {routing_key} placeholders, to use one stream per event type or routing key,
+// the routing key defaults to the event type
+type RedisStreams struct {
+	redis  *redis.Client
+	stream string
+	maxLen int64
+}
+
+// NewRedisStreams creates a new RedisStreams publisher,
+// streams are trimmed to about maxLen entries, or not at all if maxLen is zero
+func NewRedisStreams(redis *redis.Client, stream string, maxLen int64) *RedisStreams {
+	return &RedisStreams{
+		redis:  redis,
+		stream: stream,
+		maxLen: maxLen,
+	}
+}
+
+func (p *RedisStreams) PublishRaw( // nolint: golint
+	ctx context.Context,
+	body []byte,
+) (err error, recoverable bool) {
+	args, err := p.args(ctx, body)
+	if err != nil {
+		return err, true
+	}
+
+	return p.redis.XAdd(args).Err(), true
+}
+
+// PublishBatch appends all messages in a single pipeline
+func (p *RedisStreams) PublishBatch( // nolint: golint
+	messages []handler.Message,
+) (confirmed int, err error, recoverable bool) {
+	pipeline := p.redis.Pipeline()
+	defer pipeline.Close()
+
+	for _, message := range messages {
+		args, err := p.args(message.Context, message.Body)
+		if err != nil {
+			return 0, err, true
+		}
+
+		pipeline.XAdd(args)
+	}
+
+	cmds, err := pipeline.Exec()
+	if err == nil {
+		return len(messages), nil, true
+	}
+
+	// commands are executed in order, so everything up to the first failed command has been appended
+	for i, cmd := range cmds {
+		if cmd.Err() != nil {
+			return i, err, true
+		}
+	}
+
+	return 0, err, true
+}
+
+func (p *RedisStreams) args(ctx context.Context, body []byte) (*redis.XAddArgs, error) {
+	var event struct {
+		Type string `json:"type"`
+	}
+	err := json.Unmarshal(body, &event)
+	if err != nil {
+		return nil, err
+	}
+
+	routingKey := routing.Key(ctx)
+	if routingKey == "" {
+		routingKey = event.Type
+	}
+
+	return &redis.XAddArgs{
+		Stream: strings.NewReplacer(
+			"{type}", event.Type,
+			"{routing_key}", routingKey,
+		).Replace(p.stream),
+		// approximate trimming is a lot cheaper, as Redis only removes whole nodes
+		MaxLenApprox: p.maxLen,
+		Values: map[string]interface{}{
+			"type":  event.Type,
+			"event": body,
+		},
+	}, nil
+}
@@ -0,0 +1,105 @@
+package publisher
+
+import (
+	"context"
+	"sync"
+
+	"github.com/streadway/amqp"
+	"gitlab.com/Cacophony/Gateway/pkg/handler"
+	"gitlab.com/Cacophony/Gateway/pkg/routing"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub"
+)
+
+// topicPublisher publishes to gocloud topics, such as AMQP exchanges, NATS subjects, or Kafka topics,
+// events with a routing key are published to the topic of that name, others to the default topic
+type topicPublisher struct {
+	open         func(name string) (*pubsub.Topic, error)
+	defaultTopic string
+
+	lock   sync.Mutex
+	topics map[string]*pubsub.Topic
+}
+
+func newTopicPublisher(defaultTopic string, open func(name string) (*pubsub.Topic, error)) (*topicPublisher, error) {
+	p := &topicPublisher{
+		open:         open,
+		defaultTopic: defaultTopic,
+		topics:       make(map[string]*pubsub.Topic),
+	}
+
+	// fail early if the default topic cannot be opened
+	_, err := p.topic(defaultTopic)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *topicPublisher) PublishRaw( // nolint: golint
+	ctx context.Context,
+	body []byte,
+) (err error, recoverable bool) {
+	name := routing.Key(ctx)
+	if name == "" {
+		name = p.defaultTopic
+	}
+
+	topic, err := p.topic(name)
+	if err != nil {
+		return err, true
+	}
+
+	message := &pubsub.Message{
+		Body: body,
+	}
+	if priority := routing.Priority(ctx); priority > 0 {
+		message.BeforeSend = func(as func(interface{}) bool) error {
+			var publishing *amqp.Publishing
+			if as(&publishing) {
+				publishing.Priority = priority
+			}
+			return nil
+		}
+	}
+
+	err = topic.Send(ctx, message)
+	if err != nil && gcerrors.Code(err) == gcerrors.FailedPrecondition {
+		return err, false
+	}
+
+	return err, true
+}
+
+// PublishBatch publishes the messages one after another, to keep them in order
+func (p *topicPublisher) PublishBatch( // nolint: golint
+	messages []handler.Message,
+) (confirmed int, err error, recoverable bool) {
+	for i, message := range messages {
+		err, recoverable = p.PublishRaw(message.Context, message.Body)
+		if err != nil {
+			return i, err, recoverable
+		}
+	}
+
+	return len(messages), nil, true
+}
+
+func (p *topicPublisher) topic(name string) (*pubsub.Topic, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	topic, ok := p.topics[name]
+	if ok {
+		return topic, nil
+	}
+
+	topic, err := p.open(name)
+	if err != nil {
+		return nil, err
+	}
+	p.topics[name] = topic
+
+	return topic, nil
+}
@@ -0,0 +1,155 @@
+package recording
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// flushInterval is the maximum time records are buffered before they are written to the file
+const flushInterval = time.Second
+
+// Record is a single dispatch received from Discord
+type Record struct {
+	BotID      string          `json:"bot_id"`
+	ShardID    int             `json:"shard_id"`
+	ShardCount int             `json:"shard_count"`
+	Type       string          `json:"type"`
+	Sequence   int64           `json:"sequence"`
+	ReceivedAt time.Time       `json:"received_at"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// Recorder writes dispatches to a gzip compressed file, one JSON encoded Record per line
+type Recorder struct {
+	lock      sync.Mutex
+	file      *os.File
+	gzip      *gzip.Writer
+	encoder   *json.Encoder
+	lastFlush time.Time
+}
+
+// Create creates a recording at the given path, an existing file is overwritten
+func Create(path string) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := gzip.NewWriter(file)
+
+	return &Recorder{
+		file:      file,
+		gzip:      writer,
+		encoder:   json.NewEncoder(writer),
+		lastFlush: time.Now(),
+	}, nil
+}
+
+// Record writes a dispatch received by the session to the recording
+func (r *Recorder) Record(session *discordgo.Session, event *discordgo.Event) error {
+	record := &Record{
+		ShardID:    session.ShardID,
+		ShardCount: session.ShardCount,
+		Type:       event.Type,
+		Sequence:   event.Sequence,
+		ReceivedAt: time.Now().UTC(),
+		Payload:    event.RawData,
+	}
+	if session.State != nil && session.State.User != nil {
+		record.BotID = session.State.User.ID
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.encoder.Encode(record)
+	if err != nil {
+		return err
+	}
+
+	// flushing compresses worse, so only do it once in a while
+	if time.Since(r.lastFlush) >= flushInterval {
+		r.lastFlush = time.Now()
+		return r.gzip.Flush()
+	}
+
+	return nil
+}
+
+// Close writes the remaining records, and closes the file
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.gzip.Close()
+	if err != nil {
+		r.file.Close()
+		return err
+	}
+
+	return r.file.Close()
+}
+
+// Reader reads the records of a recording in order
+type Reader struct {
+	file    *os.File
+	gzip    *gzip.Reader
+	scanner *bufio.Scanner
+}
+
+// Open opens the recording at the given path
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(reader)
+	// dispatches like GUILD_CREATE of large guilds are huge
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	return &Reader{
+		file:    file,
+		gzip:    reader,
+		scanner: scanner,
+	}, nil
+}
+
+// Next returns the next record, or io.EOF at the end of the recording.
+// Recordings which have not been closed properly end with an error after the last complete record.
+func (r *Reader) Next() (*Record, error) {
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+
+	var record Record
+	err := json.Unmarshal(r.scanner.Bytes(), &record)
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// Close closes the recording
+func (r *Reader) Close() error {
+	r.gzip.Close()
+
+	return r.file.Close()
+}
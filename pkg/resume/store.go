@@ -0,0 +1,78 @@
+package resume
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// State is the information required to resume a gateway session of a shard
+type State struct {
+	SessionID        string    `json:"session_id"`
+	ResumeGatewayURL string    `json:"resume_gateway_url"`
+	Sequence         int64     `json:"sequence"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// Resumable returns true if the state contains enough information to attempt a resume
+func (s *State) Resumable() bool {
+	return s != nil && s.SessionID != "" && s.Sequence > 0
+}
+
+// Store persists the resume state of shards in Redis
+type Store struct {
+	redis *redis.Client
+	ttl   time.Duration
+}
+
+// NewStore creates a new Store, stored states expire after the given TTL,
+// as Discord will not accept resuming old sessions
+func NewStore(
+	redis *redis.Client,
+	ttl time.Duration,
+) *Store {
+	return &Store{
+		redis: redis,
+		ttl:   ttl,
+	}
+}
+
+// Get returns the stored resume state of a shard, or nil if there is none
+func (s *Store) Get(botID string, shardID int) (*State, error) {
+	res, err := s.redis.Get(stateKey(botID, shardID)).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var state State
+	err = json.Unmarshal(res, &state)
+	if err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// Set stores the resume state of a shard
+func (s *Store) Set(botID string, shardID int, state *State) error {
+	body, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return s.redis.Set(stateKey(botID, shardID), body, s.ttl).Err()
+}
+
+// Delete removes the stored resume state of a shard
+func (s *Store) Delete(botID string, shardID int) error {
+	return s.redis.Del(stateKey(botID, shardID)).Err()
+}
+
+func stateKey(botID string, shardID int) string {
+	return "cacophony.gateway.resume." + botID + "." + strconv.Itoa(shardID)
+}
@@ -0,0 +1,36 @@
+package routing
+
+import (
+	"context"
+)
+
+type (
+	routingKeyContextKey struct{}
+	priorityContextKey   struct{}
+)
+
+// WithKey returns a context which publishes with the given routing key,
+// transports use it instead of their default exchange, topic, or stream
+func WithKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, routingKeyContextKey{}, key)
+}
+
+// Key returns the routing key set on the context, or an empty string if there is none
+func Key(ctx context.Context) string {
+	key, _ := ctx.Value(routingKeyContextKey{}).(string)
+
+	return key
+}
+
+// WithPriority returns a context which publishes with the given priority, on transports which support priorities,
+// AMQP queues only apply it if they are declared with x-max-priority
+func WithPriority(ctx context.Context, priority uint8) context.Context {
+	return context.WithValue(ctx, priorityContextKey{}, priority)
+}
+
+// Priority returns the priority set on the context, or zero if there is none
+func Priority(ctx context.Context) uint8 {
+	priority, _ := ctx.Value(priorityContextKey{}).(uint8)
+
+	return priority
+}
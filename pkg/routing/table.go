@@ -0,0 +1,93 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Route matches events by type, guild, and bot, empty lists match every event,
+// matching events are published to the given topic with the given priority, or dropped
+type Route struct {
+	Types  []string `json:"types,omitempty"`
+	Guilds []string `json:"guilds,omitempty"`
+	Bots   []string `json:"bots,omitempty"`
+
+	// Topic is the exchange, topic, or stream key of the transport, see the publisher package,
+	// Priority is ignored by transports without priorities, and by AMQP queues without x-max-priority
+	Topic    string `json:"topic,omitempty"`
+	Priority uint8  `json:"priority,omitempty"`
+	Drop     bool   `json:"drop,omitempty"`
+
+	types  map[string]bool
+	guilds map[string]bool
+	bots   map[string]bool
+}
+
+// Table is an ordered list of routes, the first matching route applies
+type Table struct {
+	Routes []*Route `json:"routes"`
+}
+
+// Load reads a routing table from a JSON file, for example
+// {"routes":[{"types":["discord_presence_update"],"drop":true},{"guilds":["123"],"topic":"cacophony.vip","priority":5}]}
+func Load(path string) (*Table, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var table Table
+	err = json.Unmarshal(data, &table)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, route := range table.Routes {
+		if route == nil {
+			return nil, fmt.Errorf("route %d is empty", i)
+		}
+		if !route.Drop && route.Topic == "" && route.Priority == 0 {
+			return nil, fmt.Errorf("route %d neither drops, nor sets a topic or priority", i)
+		}
+		if route.Drop && (route.Topic != "" || route.Priority != 0) {
+			return nil, fmt.Errorf("route %d drops, but sets a topic or priority", i)
+		}
+
+		route.types = setOf(route.Types)
+		route.guilds = setOf(route.Guilds)
+		route.bots = setOf(route.Bots)
+	}
+
+	return &table, nil
+}
+
+// Match returns the first route matching the event, or nil if no route matches, a nil Table matches nothing
+func (t *Table) Match(eventType, guildID, botID string) *Route {
+	if t == nil {
+		return nil
+	}
+
+	for _, route := range t.Routes {
+		if matches(route.types, eventType) &&
+			matches(route.guilds, guildID) &&
+			matches(route.bots, botID) {
+			return route
+		}
+	}
+
+	return nil
+}
+
+func matches(set map[string]bool, value string) bool {
+	return len(set) == 0 || set[value]
+}
+
+func setOf(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+
+	return set
+}
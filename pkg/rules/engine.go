@@ -0,0 +1,91 @@
+package rules
+
+import (
+	"sync"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/go-redis/redis"
+	"go.uber.org/zap"
+)
+
+// Key is the Redis key of the JSON encoded rules, see Set
+const Key = "cacophony.gateway.rules"
+
+// Engine evaluates the rules stored in Redis, they are refreshed at the given interval
+type Engine struct {
+	redis    *redis.Client
+	logger   *zap.Logger
+	interval time.Duration
+
+	set     *Set
+	setLock sync.RWMutex
+}
+
+// NewEngine creates a new Engine, it allows every event until it has been started
+func NewEngine(
+	redis *redis.Client,
+	logger *zap.Logger,
+	interval time.Duration,
+) *Engine {
+	return &Engine{
+		redis:    redis,
+		logger:   logger,
+		interval: interval,
+	}
+}
+
+// Start loads the rules, and keeps refreshing them in the background,
+// invalid rules are rejected, and the previous rules are kept
+func (e *Engine) Start() error {
+	set, err := e.get()
+	if err != nil {
+		return err
+	}
+
+	e.setLock.Lock()
+	e.set = set
+	e.setLock.Unlock()
+
+	go func() {
+		for {
+			time.Sleep(e.interval)
+
+			set, err := e.get()
+			if err != nil {
+				raven.CaptureError(err, nil)
+				e.logger.Error("failed to retrieve rules", zap.Error(err))
+				continue
+			}
+
+			e.setLock.Lock()
+			e.set = set
+			e.setLock.Unlock()
+
+			e.logger.Debug("cached rules")
+		}
+	}()
+
+	return nil
+}
+
+// Allowed reports whether an event should be published, see Set.Allowed
+func (e *Engine) Allowed(eventType, guildID, channelID, botID string) bool {
+	e.setLock.RLock()
+	defer e.setLock.RUnlock()
+
+	return e.set.Allowed(eventType, guildID, channelID, botID)
+}
+
+// get retrieves the rules, there are none if the key does not exist
+func (e *Engine) get() (*Set, error) {
+	data, err := e.redis.Get(Key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(data)
+}
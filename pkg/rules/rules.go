@@ -0,0 +1,119 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Action decides whether matching events are published
+type Action string
+
+// actions of rules
+const (
+	Allow Action = "allow"
+	Deny  Action = "deny"
+)
+
+// Rule matches events by type, guild, channel, and bot, empty lists match every event.
+// Types ending with * match every type with that prefix, e.g. discord_guild_member_*.
+type Rule struct {
+	Types    []string `json:"types,omitempty"`
+	Guilds   []string `json:"guilds,omitempty"`
+	Channels []string `json:"channels,omitempty"`
+	Bots     []string `json:"bots,omitempty"`
+	Action   Action   `json:"action"`
+
+	types    map[string]bool
+	prefixes []string
+	guilds   map[string]bool
+	channels map[string]bool
+	bots     map[string]bool
+}
+
+// Set is an ordered list of rules, the first matching rule decides, events matching no rule are allowed.
+// To only allow some types for a guild, allow them first, then deny the guild:
+// {"rules":[{"guilds":["123"],"types":["discord_message_create","discord_guild_member_*"],"action":"allow"},
+// {"guilds":["123"],"action":"deny"}]}
+type Set struct {
+	Rules []*Rule `json:"rules"`
+}
+
+// Parse parses and validates a JSON encoded Set
+func Parse(data []byte) (*Set, error) {
+	var set Set
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, rule := range set.Rules {
+		if rule == nil {
+			return nil, fmt.Errorf("rule %d is empty", i)
+		}
+		if rule.Action != Allow && rule.Action != Deny {
+			return nil, fmt.Errorf("rule %d has invalid action %q", i, rule.Action)
+		}
+
+		rule.types = make(map[string]bool, len(rule.Types))
+		for _, eventType := range rule.Types {
+			if strings.HasSuffix(eventType, "*") {
+				rule.prefixes = append(rule.prefixes, strings.TrimSuffix(eventType, "*"))
+				continue
+			}
+			rule.types[eventType] = true
+		}
+		rule.guilds = setOf(rule.Guilds)
+		rule.channels = setOf(rule.Channels)
+		rule.bots = setOf(rule.Bots)
+	}
+
+	return &set, nil
+}
+
+// Allowed reports whether an event should be published, a nil Set allows every event
+func (s *Set) Allowed(eventType, guildID, channelID, botID string) bool {
+	if s == nil {
+		return true
+	}
+
+	for _, rule := range s.Rules {
+		if rule.matchesType(eventType) &&
+			matches(rule.guilds, guildID) &&
+			matches(rule.channels, channelID) &&
+			matches(rule.bots, botID) {
+			return rule.Action == Allow
+		}
+	}
+
+	return true
+}
+
+func (r *Rule) matchesType(eventType string) bool {
+	if len(r.types) == 0 && len(r.prefixes) == 0 {
+		return true
+	}
+	if r.types[eventType] {
+		return true
+	}
+	for _, prefix := range r.prefixes {
+		if strings.HasPrefix(eventType, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matches(set map[string]bool, value string) bool {
+	return len(set) == 0 || set[value]
+}
+
+func setOf(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+
+	return set
+}
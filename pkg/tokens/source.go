@@ -0,0 +1,60 @@
+package tokens
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/go-redis/redis"
+)
+
+// Source loads bot tokens by bot ID
+type Source interface {
+	Load() (map[string]string, error)
+}
+
+// FileSource loads bot tokens from a JSON file, containing an object of bot IDs to tokens
+type FileSource struct {
+	path string
+}
+
+// NewFileSource creates a new FileSource
+func NewFileSource(path string) *FileSource {
+	return &FileSource{
+		path: path,
+	}
+}
+
+// Load reads the tokens from the file
+func (s *FileSource) Load() (map[string]string, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens map[string]string
+	err = json.Unmarshal(data, &tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// RedisSource loads bot tokens from a Redis hash, with bot IDs as fields and tokens as values
+type RedisSource struct {
+	redis *redis.Client
+	key   string
+}
+
+// NewRedisSource creates a new RedisSource
+func NewRedisSource(redis *redis.Client, key string) *RedisSource {
+	return &RedisSource{
+		redis: redis,
+		key:   key,
+	}
+}
+
+// Load reads the tokens from the hash, a missing hash contains no tokens
+func (s *RedisSource) Load() (map[string]string, error) {
+	return s.redis.HGetAll(s.key).Result()
+}
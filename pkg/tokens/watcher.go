@@ -0,0 +1,153 @@
+package tokens
+
+import (
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"go.uber.org/zap"
+)
+
+// Handler starts and stops bots whose tokens have been added to or removed from a Source
+type Handler interface {
+	Add(botID, token string) error
+	Remove(botID string) error
+}
+
+// retryIntervalMax is the longest time to wait before adding a bot again, after adding it failed
+const retryIntervalMax = 10 * time.Minute
+
+// Watcher polls a Source, and passes on tokens which have been added, removed, or changed
+type Watcher struct {
+	source   Source
+	logger   *zap.Logger
+	interval time.Duration
+
+	current map[string]string
+	// failed are tokens which could not be added, they are retried with backoff until they are added or change
+	failed map[string]*failedToken
+}
+
+type failedToken struct {
+	token    string
+	attempts int
+	retryAt  time.Time
+}
+
+// NewWatcher creates a new Watcher
+func NewWatcher(
+	source Source,
+	logger *zap.Logger,
+	interval time.Duration,
+) *Watcher {
+	return &Watcher{
+		source:   source,
+		logger:   logger,
+		interval: interval,
+		failed:   make(map[string]*failedToken),
+	}
+}
+
+// Load loads the initial tokens, later changes are compared against them
+func (w *Watcher) Load() (map[string]string, error) {
+	tokens, err := w.source.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	w.current = make(map[string]string, len(tokens))
+	for botID, token := range tokens {
+		w.current[botID] = token
+	}
+
+	return tokens, nil
+}
+
+// Watch polls the source on every interval, and passes on changes to the handler, it blocks forever
+func (w *Watcher) Watch(handler Handler) {
+	for {
+		time.Sleep(w.interval)
+
+		tokens, err := w.source.Load()
+		if err != nil {
+			raven.CaptureError(err, nil)
+			w.logger.Error("failed to load tokens", zap.Error(err))
+			continue
+		}
+
+		w.apply(handler, tokens)
+	}
+}
+
+func (w *Watcher) apply(handler Handler, tokens map[string]string) {
+	for botID, token := range w.current {
+		newToken, ok := tokens[botID]
+		if ok && newToken == token {
+			continue
+		}
+
+		w.logger.Info("token removed or changed, removing bot", zap.String("bot_id", botID))
+		err := handler.Remove(botID)
+		if err != nil {
+			w.logger.Error("failed to remove bot",
+				zap.Error(err),
+				zap.String("bot_id", botID),
+			)
+		}
+		delete(w.current, botID)
+	}
+
+	for botID, failed := range w.failed {
+		if newToken, ok := tokens[botID]; !ok || newToken != failed.token {
+			delete(w.failed, botID)
+		}
+	}
+
+	for botID, token := range tokens {
+		if _, ok := w.current[botID]; ok {
+			continue
+		}
+
+		failed := w.failed[botID]
+		if failed != nil && time.Now().Before(failed.retryAt) {
+			continue
+		}
+
+		w.logger.Info("token added, adding bot", zap.String("bot_id", botID))
+		err := handler.Add(botID, token)
+		if err == nil {
+			w.current[botID] = token
+			delete(w.failed, botID)
+			continue
+		}
+
+		if failed == nil {
+			failed = &failedToken{token: token}
+			w.failed[botID] = failed
+		}
+		failed.retryAt = time.Now().Add(w.retryInterval(failed.attempts))
+		failed.attempts++
+
+		raven.CaptureError(err, nil)
+		w.logger.Error("failed to add bot, retrying",
+			zap.Error(err),
+			zap.String("bot_id", botID),
+			zap.Int("attempt", failed.attempts),
+			zap.Time("retry_at", failed.retryAt),
+		)
+	}
+}
+
+// retryInterval returns the time to wait before adding a bot again after the given number of failed attempts,
+// it doubles with every attempt, starting at the polling interval
+func (w *Watcher) retryInterval(attempts int) time.Duration {
+	if attempts >= 16 {
+		return retryIntervalMax
+	}
+
+	interval := w.interval << uint(attempts)
+	if interval <= 0 || interval > retryIntervalMax {
+		return retryIntervalMax
+	}
+
+	return interval
+}
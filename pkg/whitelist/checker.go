@@ -6,6 +6,7 @@ import (
 
 	raven "github.com/getsentry/raven-go"
 	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
@@ -15,12 +16,15 @@ type Checker struct {
 	interval time.Duration
 	enable   bool
 
-	whitelist      map[string]interface{}
-	whitelistSlice []string
-	whitelistLock  sync.RWMutex
-	blacklist      map[string]interface{}
-	blacklistSlice []string
-	blacklistLock  sync.RWMutex
+	whitelist       map[string]interface{}
+	whitelistSlice  []string
+	whitelistLock   sync.RWMutex
+	blacklist       map[string]interface{}
+	blacklistSlice  []string
+	blacklistLock   sync.RWMutex
+	refreshLock     sync.Mutex
+	lastRefresh     time.Time
+	lastRefreshLock sync.RWMutex
 }
 
 func NewChecker(
@@ -37,59 +41,95 @@ func NewChecker(
 	}
 }
 
+// Start subscribes to updates, and caches the whitelist and blacklist,
+// they are refreshed on every update, and polled every interval in case an update got lost
 func (c *Checker) Start() error {
-	var err error
-
-	c.whitelistLock.Lock()
-	c.whitelistSlice, c.whitelist, err = c.get(whitelistKey)
-	c.whitelistLock.Unlock()
-	if err != nil && err != redis.Nil {
-		return err
+	// subscribe before the initial refresh, so no update in between is missed
+	pubsub := c.redis.Subscribe()
+	err := pubsub.Subscribe(UpdatesChannel)
+	if err != nil {
+		pubsub.Close() // nolint: errcheck
+		return errors.Wrap(err, "failed to subscribe to whitelist updates")
 	}
 
-	c.blacklistLock.Lock()
-	c.blacklistSlice, c.blacklist, err = c.get(blacklistKey)
-	c.blacklistLock.Unlock()
-	if err != nil && err != redis.Nil {
+	err = c.refresh()
+	if err != nil {
+		pubsub.Close() // nolint: errcheck
 		return err
 	}
 
 	go func() {
-		var err error
-		var whitelist, blacklist map[string]interface{}
-		var whitelistSlice, blacklistSlice []string
+		for range pubsub.Channel() {
+			c.refreshOrLog("received whitelist update")
+		}
+	}()
+
+	go func() {
 		for {
 			time.Sleep(c.interval)
 
-			whitelistSlice, whitelist, err = c.get(whitelistKey)
-			if err != nil && err != redis.Nil {
-				raven.CaptureError(err, nil)
-				c.logger.Error("failed to retrieve whitelist", zap.Error(err))
-			} else {
-				c.whitelistLock.Lock()
-				c.whitelist = whitelist
-				c.whitelistSlice = whitelistSlice
-				c.whitelistLock.Unlock()
-			}
-
-			blacklistSlice, blacklist, err = c.get(blacklistKey)
-			if err != nil && err != redis.Nil {
-				raven.CaptureError(err, nil)
-				c.logger.Error("failed to retrieve blacklist", zap.Error(err))
-			} else {
-				c.blacklistLock.Lock()
-				c.blacklist = blacklist
-				c.blacklistSlice = blacklistSlice
-				c.blacklistLock.Unlock()
-			}
-
-			c.logger.Debug("cached whitelist and blacklist")
+			c.refreshOrLog("polled whitelist")
 		}
 	}()
 
 	return nil
 }
 
+// LastRefresh returns when the whitelist and blacklist were last retrieved successfully
+func (c *Checker) LastRefresh() time.Time {
+	c.lastRefreshLock.RLock()
+	defer c.lastRefreshLock.RUnlock()
+
+	return c.lastRefresh
+}
+
+func (c *Checker) refreshOrLog(reason string) {
+	err := c.refresh()
+	if err != nil {
+		raven.CaptureError(err, nil)
+		c.logger.Error("failed to refresh whitelist and blacklist",
+			zap.String("reason", reason),
+			zap.Error(err),
+		)
+		return
+	}
+
+	c.logger.Debug("cached whitelist and blacklist", zap.String("reason", reason))
+}
+
+// refresh retrieves and caches the whitelist and blacklist,
+// refreshes are serialised so an older result never overwrites a newer one
+func (c *Checker) refresh() error {
+	c.refreshLock.Lock()
+	defer c.refreshLock.Unlock()
+
+	whitelistSlice, whitelist, err := c.get(whitelistKey)
+	if err != nil && err != redis.Nil {
+		return errors.Wrap(err, "failed to retrieve whitelist")
+	}
+
+	blacklistSlice, blacklist, err := c.get(blacklistKey)
+	if err != nil && err != redis.Nil {
+		return errors.Wrap(err, "failed to retrieve blacklist")
+	}
+
+	c.whitelistLock.Lock()
+	c.whitelist = whitelist
+	c.whitelistSlice = whitelistSlice
+	c.whitelistLock.Unlock()
+
+	c.blacklistLock.Lock()
+	c.blacklist = blacklist
+	c.blacklistSlice = blacklistSlice
+	c.blacklistLock.Unlock()
+
+	c.lastRefreshLock.Lock()
+	c.lastRefresh = time.Now()
+	c.lastRefreshLock.Unlock()
+
+	return nil
+}
+
 func (c *Checker) IsWhitelisted(guildID string) bool {
 	if !c.enable {
 		return true
@@ -7,6 +7,10 @@ import (
 const (
 	whitelistKey = "cacophony.whitelist.whitelist"
 	blacklistKey = "cacophony.whitelist.blacklist"
+
+	// UpdatesChannel is the Redis channel to publish to after changing the whitelist or blacklist,
+	// checkers refresh on every message, the payload is ignored
+	UpdatesChannel = "cacophony.whitelist.updates"
 )
 
 func (c *Checker) get(key string) ([]string, map[string]interface{}, error) {